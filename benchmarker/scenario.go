@@ -67,11 +67,11 @@ func loadAssets(s *checker.Session) {
 	a.Description = "timeago.min.jsが読み込めること"
 	a.Play(s)
 
-	a = checker.NewAssetAction("/js/main.js", &checker.Asset{MD5: "9c309fed7e360c57a705978dab2c68ad"})
+	a = checker.NewAssetAction("/js/main.js", &checker.Asset{MD5: "b7f5b9404d9ec4097c7e23c14c09a662"})
 	a.Description = "main.jsが読み込めること"
 	a.Play(s)
 
-	a = checker.NewAssetAction("/css/style.css", &checker.Asset{MD5: "e4c3606a18d11863189405eb5c6ca551"})
+	a = checker.NewAssetAction("/css/style.css", &checker.Asset{MD5: "fbf6699f5fdcb22029e74b93913a6417"})
 	a.Description = "style.cssが読み込めること"
 	a.Play(s)
 }
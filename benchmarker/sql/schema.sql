@@ -4,7 +4,7 @@ DROP TABLE IF EXISTS users;
 CREATE TABLE users (
   `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `account_name` varchar(64) NOT NULL UNIQUE,
-  `passhash` varchar(128) NOT NULL, -- SHA2 512 non-binary (hex)
+  `passhash` varchar(128) NOT NULL, -- SHA2 512 non-binary (hex) または bcrypt
   `authority` tinyint(1) NOT NULL DEFAULT 0,
   `del_flg` tinyint(1) NOT NULL DEFAULT 0,
   `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
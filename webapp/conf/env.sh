@@ -1,4 +1,5 @@
 PATH=/usr/local/bin:/home/isucon/.local/ruby/bin:/home/isucon/.local/node/bin:/home/isucon/.local/python3/bin:/home/isucon/.local/perl/bin:/home/isucon/.local/php/bin:/home/isucon/.local/php/sbin:/home/isucon/.local/go/bin:/home/isucon/.local/scala/bin:/usr/bin/:/bin/:$PATH
 ISUCONP_DB_USER=isuconp
 ISUCONP_DB_PASSWORD=isuconp
-ISUCONP_DB_NAME=isuconp
\ No newline at end of file
+ISUCONP_DB_NAME=isuconp
+ISUCONP_REAL_IP_HEADER=X-Real-IP
\ No newline at end of file
@@ -0,0 +1,20 @@
+package main
+
+import "regexp"
+
+// アカウント名の規則。登録時の検証、/@{accountName} のルーティング、テンプレートのリンクで共有する
+const accountNamePattern = `[0-9a-zA-Z_]{3,}`
+
+var accountNameRegexp = regexp.MustCompile(`\A` + accountNamePattern + `\z`)
+
+// /@{accountName} と、その下のルートの接頭辞
+const accountRoute = "/@{accountName:" + accountNamePattern + "}"
+
+func isValidAccountName(accountName string) bool {
+	return accountNameRegexp.MatchString(accountName)
+}
+
+// プロフィールページのURL
+func accountURL(accountName string) string {
+	return "/@" + accountName
+}
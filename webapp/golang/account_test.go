@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 登録できるアカウント名はすべてプロフィールページにルーティングされること
+func TestAccountRoute_registrableNames(t *testing.T) {
+	names := []string{
+		"abc",
+		"ABC",
+		"isucon",
+		"user123",
+		"123",
+		"___",
+		"snake_case",
+		"_leading",
+		"trailing_",
+		"Mixed_Case_99",
+		"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+	}
+
+	r := newRouter()
+	for _, name := range names {
+		if !validateUser(name, "password") {
+			t.Errorf("expected %q to be accepted at registration", name)
+			continue
+		}
+
+		for _, suffix := range []string{"", "/posts"} {
+			path := accountURL(name) + suffix
+
+			rctx := chi.NewRouteContext()
+			if !r.Match(rctx, "GET", path) {
+				t.Errorf("expected %q to match a route", path)
+				continue
+			}
+			if pattern := rctx.RoutePattern(); pattern != accountRoute+suffix {
+				t.Errorf("expected %q to route to %q but got %q", path, accountRoute+suffix, pattern)
+			}
+			if got := rctx.URLParam("accountName"); got != name {
+				t.Errorf("expected accountName of %q to eq %q but got %q", path, name, got)
+			}
+		}
+	}
+}
+
+func TestAccountRoute_rejectedNames(t *testing.T) {
+	names := []string{"", "ab", "a-b-c", "abc.def", "日本語の名前"}
+
+	r := newRouter()
+	for _, name := range names {
+		if validateUser(name, "password") {
+			t.Errorf("expected %q to be rejected at registration", name)
+		}
+
+		rctx := chi.NewRouteContext()
+		r.Match(rctx, "GET", accountURL(name))
+		if rctx.RoutePattern() == accountRoute {
+			t.Errorf("expected %q not to route to the profile page", accountURL(name))
+		}
+	}
+}
+
+// bcryptは72バイトまでしか扱えないので、それより長いパスワードでも登録・照合できること
+func TestPassword_longerThanBcryptLimit(t *testing.T) {
+	long := strings.Repeat("a", 72) + "_long_password"
+	if !validateUser("longpassword", long) {
+		t.Fatalf("expected a %d-byte password to be accepted at registration", len(long))
+	}
+
+	passhash, err := hashPassword(long)
+	if err != nil {
+		t.Fatalf("expected a %d-byte password to be hashed but got %v", len(long), err)
+	}
+	u := User{AccountName: "longpassword", Passhash: passhash}
+	if !verifyPassword(u, long) {
+		t.Errorf("expected the %d-byte password to verify", len(long))
+	}
+
+	// 73バイト目以降が違うパスワードは通さない
+	for _, other := range []string{strings.Repeat("a", 72), strings.Repeat("a", 72) + "_other"} {
+		if verifyPassword(u, other) {
+			t.Errorf("expected %q not to verify", other)
+		}
+	}
+}
+
+// 72バイト以下のパスワードはそのままbcryptに渡していたので、以前のハッシュも照合できること
+func TestPassword_existingBcryptHash(t *testing.T) {
+	password := strings.Repeat("a", 72)
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifyPassword(User{Passhash: string(hash)}, password) {
+		t.Errorf("expected a hash of the raw %d-byte password to verify", len(password))
+	}
+}
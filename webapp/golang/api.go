@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// JSON APIのレスポンス。HTML版と同じfetch*関数で組み立てたPostから変換する
+type apiUser struct {
+	ID          int       `json:"id"`
+	AccountName string    `json:"account_name"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type apiComment struct {
+	ID        int       `json:"id"`
+	PostID    int       `json:"post_id"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+	User      apiUser   `json:"user"`
+}
+
+type apiPost struct {
+	ID           int          `json:"id"`
+	Body         string       `json:"body"`
+	Mime         string       `json:"mime"`
+	ImageURL     string       `json:"image_url"`
+	CreatedAt    time.Time    `json:"created_at"`
+	CommentCount int          `json:"comment_count"`
+	LikeCount    int          `json:"like_count"`
+	LikedByMe    bool         `json:"liked_by_me"`
+	Comments     []apiComment `json:"comments"`
+	User         apiUser      `json:"user"`
+}
+
+type apiPaging struct {
+	Next string `json:"next,omitempty"`
+}
+
+type apiPostList struct {
+	Posts  []apiPost `json:"posts"`
+	Paging apiPaging `json:"paging"`
+}
+
+type apiUserDetail struct {
+	User           apiUser `json:"user"`
+	PostCount      int     `json:"post_count"`
+	CommentCount   int     `json:"comment_count"`
+	CommentedCount int     `json:"commented_count"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func newAPIUser(u User) apiUser {
+	return apiUser{
+		ID:          u.ID,
+		AccountName: u.AccountName,
+		CreatedAt:   u.CreatedAt,
+	}
+}
+
+func newAPIPost(p Post) apiPost {
+	comments := make([]apiComment, 0, len(p.Comments))
+	for _, c := range p.Comments {
+		comments = append(comments, apiComment{
+			ID:        c.ID,
+			PostID:    c.PostID,
+			Comment:   c.Comment,
+			CreatedAt: c.CreatedAt,
+			User:      newAPIUser(c.User),
+		})
+	}
+
+	return apiPost{
+		ID:           p.ID,
+		Body:         p.Body,
+		Mime:         p.Mime,
+		ImageURL:     imageURL(p),
+		CreatedAt:    p.CreatedAt,
+		CommentCount: p.CommentCount,
+		LikeCount:    p.LikeCount,
+		LikedByMe:    p.LikedByMe,
+		Comments:     comments,
+		User:         newAPIUser(p.User),
+	}
+}
+
+func newAPIPostList(posts []Post, basePath string) apiPostList {
+	list := apiPostList{Posts: make([]apiPost, 0, len(posts))}
+	for _, p := range posts {
+		list.Posts = append(list.Posts, newAPIPost(p))
+	}
+	list.Paging.Next = nextPageURL(posts, basePath)
+
+	return list
+}
+
+// cursorパラメータがなければnilを返す
+func apiCursor(r *http.Request) (*Cursor, error) {
+	c := r.URL.Query().Get("cursor")
+	if c == "" {
+		return nil, nil
+	}
+
+	return parseCursor(c)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int) {
+	writeJSON(w, status, apiError{Error: http.StatusText(status)})
+}
+
+func apiGetPosts(w http.ResponseWriter, r *http.Request) {
+	cursor, err := apiCursor(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest)
+		return
+	}
+
+	var posts []Post
+	if cursor == nil {
+		posts, err = fetchIndexPosts()
+	} else {
+		posts, err = fetchTimelinePosts(cursor)
+	}
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError)
+		return
+	}
+
+	posts, err = withViewer(posts, "", getSessionUser(r))
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPIPostList(posts, "/api/v1/posts"))
+}
+
+func apiGetPostsID(w http.ResponseWriter, r *http.Request) {
+	pid, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound)
+		return
+	}
+
+	p, err := fetchPost(pid)
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError)
+		return
+	}
+
+	if p == nil {
+		writeJSONError(w, http.StatusNotFound)
+		return
+	}
+
+	posts, err := withViewer([]Post{*p}, "", getSessionUser(r))
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPIPost(posts[0]))
+}
+
+func apiGetUser(w http.ResponseWriter, r *http.Request) {
+	user, err := fetchActiveUser(chi.URLParam(r, "accountName"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError)
+		return
+	}
+
+	stats, err := fetchUserStats(user.ID)
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, apiUserDetail{
+		User:           newAPIUser(user),
+		PostCount:      stats.PostCount,
+		CommentCount:   stats.CommentCount,
+		CommentedCount: stats.CommentedCount,
+	})
+}
+
+func apiGetUserPosts(w http.ResponseWriter, r *http.Request) {
+	user, err := fetchActiveUser(chi.URLParam(r, "accountName"))
+	if errors.Is(err, sql.ErrNoRows) {
+		writeJSONError(w, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError)
+		return
+	}
+
+	cursor, err := apiCursor(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest)
+		return
+	}
+
+	posts, err := fetchUserPosts(user.ID, cursor)
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError)
+		return
+	}
+
+	posts, err = withViewer(posts, "", getSessionUser(r))
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPIPostList(posts, "/api/v1/users/"+user.AccountName+"/posts"))
+}
+
+func apiRouter() http.Handler {
+	r := chi.NewRouter()
+
+	r.Get("/posts", apiGetPosts)
+	r.Get("/posts/{id}", apiGetPostsID)
+	r.Get("/users/{accountName:"+accountNamePattern+"}", apiGetUser)
+	r.Get("/users/{accountName:"+accountNamePattern+"}/posts", apiGetUserPosts)
+	r.Get("/search", apiGetSearch)
+
+	return r
+}
@@ -1,43 +1,67 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	crand "crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
-	"encoding/gob"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"html/template"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/bradfitz/gomemcache/memcache"
-	gsm "github.com/bradleypeabody/gorilla-sessions-memcache"
+	"github.com/catatsuy/private-isu/webapp/golang/cache"
+	"github.com/catatsuy/private-isu/webapp/golang/imagestore"
+	"github.com/catatsuy/private-isu/webapp/golang/ratelimit"
 	"github.com/go-chi/chi/v5"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/profile"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var (
-	db       *sqlx.DB
-	store    *gsm.MemcacheStore
-	mc       *memcache.Client
-	profiler interface{ Stop() }
+	db         *sqlx.DB
+	store      sessions.Store
+	mc         *memcache.Client
+	imageStore imagestore.Store
+	profiler   interface{ Stop() }
 )
 
 const (
 	postsPerPage  = 20
 	ISO8601Format = "2006-01-02T15:04:05-07:00"
 	UploadLimit   = 10 * 1024 * 1024 // 10mb
+
+	moderationLogLimit = 100
+	reasonMaxLength    = 255
+)
+
+// moderation_logs.action の値
+const (
+	moderationBan            = "ban"
+	moderationUnban          = "unban"
+	moderationHidePost       = "hide_post"
+	moderationRestorePost    = "restore_post"
+	moderationHideComment    = "hide_comment"
+	moderationRestoreComment = "restore_comment"
 )
 
 type User struct {
@@ -47,6 +71,8 @@ type User struct {
 	Authority   int       `db:"authority"`
 	DelFlg      int       `db:"del_flg"`
 	CreatedAt   time.Time `db:"created_at"`
+	// ログイン中のユーザーだけgetSessionUserで埋める
+	UnreadNotificationCount int `db:"-"`
 }
 
 type Post struct {
@@ -57,9 +83,12 @@ type Post struct {
 	Mime         string    `db:"mime"`
 	CreatedAt    time.Time `db:"created_at"`
 	CommentCount int
+	LikeCount    int
 	Comments     []Comment
 	User         User
-	CSRFToken    string
+	// 以下は描画時にwithViewerで埋める
+	CSRFToken string
+	LikedByMe bool
 }
 
 type Comment struct {
@@ -71,6 +100,46 @@ type Comment struct {
 	User      User
 }
 
+type ModerationLog struct {
+	ID               int       `db:"id"`
+	AdminID          int       `db:"admin_id"`
+	UserID           int       `db:"user_id"`
+	Action           string    `db:"action"`
+	Reason           string    `db:"reason"`
+	CreatedAt        time.Time `db:"created_at"`
+	ContentID        int       `db:"content_id"` // 投稿・コメントの操作のときだけ
+	AdminAccountName string    `db:"admin_account_name"`
+	UserAccountName  string    `db:"user_account_name"`
+}
+
+func (l ModerationLog) ActionLabel() string {
+	switch l.Action {
+	case moderationBan:
+		return "BAN"
+	case moderationUnban:
+		return "BAN解除"
+	case moderationHidePost:
+		return "投稿を非表示"
+	case moderationRestorePost:
+		return "投稿を復元"
+	case moderationHideComment:
+		return "コメントを非表示"
+	case moderationRestoreComment:
+		return "コメントを復元"
+	}
+	return l.Action
+}
+
+// 管理者が非表示にした投稿またはコメント
+type HiddenContent struct {
+	ID           int       `db:"id"`
+	PostID       int       `db:"post_id"`
+	AccountName  string    `db:"account_name"`
+	Body         string    `db:"body"`
+	HiddenReason string    `db:"hidden_reason"`
+	HiddenAt     time.Time `db:"hidden_at"`
+}
+
 type PostUser struct {
 	PostID           int       `db:"post_id"`
 	PostUserID       int       `db:"post_user_id"`
@@ -95,64 +164,48 @@ type PostUser struct {
 }
 
 func init() {
-	memdAddr := os.Getenv("ISUCONP_MEMCACHED_ADDRESS")
-	if memdAddr == "" {
-		memdAddr = "localhost:11211"
-	}
-	mc = memcache.New(memdAddr)
-	store = gsm.NewMemcacheStore(mc, "iscogram_", []byte("sendagaya"))
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 }
 
-func dbInitialize() {
+// テーブルやインデックスはmigrateSchemaで起動時に作る
+func dbInitialize() error {
+	// 非表示を解除する投稿の画像を公開URLに戻しておく
+	if _, ok := imageStore.(imagestore.Hider); ok {
+		hidden := []Post{}
+		err := db.Select(&hidden, "SELECT `id`, `mime` FROM `posts` WHERE `id` <= 10000 AND `hidden_at` IS NOT NULL")
+		if err != nil {
+			log.Print(err)
+		}
+		for _, p := range hidden {
+			err := setPostImagesHidden(context.Background(), p.ID, p.Mime, false)
+			if err != nil {
+				log.Print(err)
+			}
+		}
+	}
+
 	sqls := []string{
 		"DELETE FROM users WHERE id > 1000",
 		"DELETE FROM posts WHERE id > 10000",
 		"DELETE FROM comments WHERE id > 100000",
+		"DELETE FROM post_image_variants WHERE post_id > 10000",
+		"DELETE FROM moderation_logs",
+		"DELETE FROM follows",
+		"DELETE FROM likes",
+		"DELETE FROM post_tags",
+		"DELETE FROM tags",
+		"DELETE FROM notifications",
 		"UPDATE users SET del_flg = 0",
 		"UPDATE users SET del_flg = 1 WHERE id % 50 = 0",
-		"ALTER TABLE `comments` ADD INDEX `post_id_index` (`post_id`, `created_at` DESC);",
-		"ALTER TABLE `comments` ADD INDEX `user_id_index` (`user_id`);",
-		"ALTER TABLE `posts` ADD INDEX `created_at_index` (`created_at` DESC);",
-		"ALTER TABLE `posts` ADD INDEX `user_id_created_at_index` (`user_id`, `created_at` DESC);",
+		"UPDATE posts SET hidden_at = NULL, hidden_reason = '' WHERE hidden_at IS NOT NULL",
+		"UPDATE comments SET hidden_at = NULL, hidden_reason = '' WHERE hidden_at IS NOT NULL",
 	}
 
 	for _, sql := range sqls {
-		db.Exec(sql)
-	}
-}
-
-// 構造体をMemcacheにセットする関数
-func setStructToMemcache(mc *memcache.Client, key string, value interface{}) error {
-	// 構造体をバイナリデータにシリアライズ
-	var buffer bytes.Buffer
-	encoder := gob.NewEncoder(&buffer)
-	err := encoder.Encode(value)
-	if err != nil {
-		return err
-	}
-
-	// Memcacheにセット
-	item := &memcache.Item{
-		Key:        key,
-		Value:      buffer.Bytes(),
-		Expiration: 5,
-	}
-	return mc.Set(item)
-}
-
-// Memcacheから構造体を取得する関数
-func getStructFromMemcache(mc *memcache.Client, key string, v interface{}) error {
-	item, err := mc.Get(key)
-	if err != nil {
-		return err
-	}
-
-	// バイナリデータを指定された構造体にデシリアライズ
-	buffer := bytes.NewBuffer(item.Value)
-	decoder := gob.NewDecoder(buffer)
-	if err := decoder.Decode(v); err != nil {
-		return err
+		_, err := db.Exec(sql)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -164,15 +217,20 @@ func tryLogin(accountName, password string) *User {
 		return nil
 	}
 
-	if calculatePasshash(u.AccountName, password) == u.Passhash {
-		return &u
-	} else {
+	if !verifyPassword(u, password) {
 		return nil
 	}
+
+	// 旧形式のハッシュはログインに成功したときに置き換える
+	if isLegacyPasshash(u.Passhash) {
+		upgradePasshash(&u, password)
+	}
+
+	return &u
 }
 
 func validateUser(accountName, password string) bool {
-	return regexp.MustCompile(`\A[0-9a-zA-Z_]{3,}\z`).MatchString(accountName) &&
+	return isValidAccountName(accountName) &&
 		regexp.MustCompile(`\A[0-9a-zA-Z_]{6,}\z`).MatchString(password)
 }
 
@@ -202,10 +260,59 @@ func calculateSalt(accountName string) string {
 	return digest(accountName)
 }
 
+// 旧形式。新規登録では使わず、移行前のユーザーの照合にだけ使う
 func calculatePasshash(accountName, password string) string {
 	return digest(password + ":" + calculateSalt(accountName))
 }
 
+// passhashカラムには旧形式のSHA-512(hex 128文字)とbcrypt($2a$...)が混在する
+func isLegacyPasshash(passhash string) bool {
+	return !strings.HasPrefix(passhash, "$2")
+}
+
+// bcryptは72バイトを超えるパスワードを受け付けないので、長いものだけSHA-256のhexにしてから渡す
+// 72バイト以下はそのまま渡すので、これまでに作ったハッシュもそのまま照合できる
+func bcryptPassword(password string) []byte {
+	if len(password) <= 72 {
+		return []byte(password)
+	}
+	sum := sha256.Sum256([]byte(password))
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(bcryptPassword(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func verifyPassword(u User, password string) bool {
+	if isLegacyPasshash(u.Passhash) {
+		legacy := calculatePasshash(u.AccountName, password)
+		return subtle.ConstantTimeCompare([]byte(legacy), []byte(u.Passhash)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(u.Passhash), bcryptPassword(password)) == nil
+}
+
+// 同時にログインした別のリクエストが先に更新していたら何もしない
+func upgradePasshash(u *User, password string) {
+	passhash, err := hashPassword(password)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	_, err = db.Exec("UPDATE `users` SET `passhash` = ? WHERE `id` = ? AND `passhash` = ?", passhash, u.ID, u.Passhash)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	u.Passhash = passhash
+	invalidateUserCache(u.ID)
+}
+
 func getSession(r *http.Request) *sessions.Session {
 	session, _ := store.Get(r, "isuconp-go.session")
 
@@ -219,13 +326,27 @@ func getSessionUser(r *http.Request) User {
 		return User{}
 	}
 
-	u := User{}
+	var id int
+	switch v := uid.(type) {
+	case int:
+		id = v
+	case int64:
+		id = int(v)
+	default:
+		return User{}
+	}
 
-	err := db.Get(&u, "SELECT * FROM `users` WHERE `id` = ?", uid)
+	u, err := fetchUser(id)
 	if err != nil {
 		return User{}
 	}
 
+	// 件数が取れなくてもページは表示する
+	u.UnreadNotificationCount, err = fetchUnreadNotificationCount(u.ID)
+	if err != nil {
+		log.Print(err)
+	}
+
 	return u
 }
 
@@ -242,63 +363,179 @@ func getFlash(w http.ResponseWriter, r *http.Request, key string) string {
 	}
 }
 
-func fastMakePosts(results []PostUser, csrfToken string, allComments bool) ([]Post, error) {
+const indexCacheKey = "index"
 
-	var posts []Post
-	for _, r := range results {
-		key := "comment_" + strconv.Itoa(r.PostID)
-		if allComments {
-			key += "_all"
-		}
-		var comments []Comment
-		err := getStructFromMemcache(mc, key, &comments)
+var (
+	postsCache        *cache.Cache[[]Post]
+	commentsCache     *cache.Cache[[]Comment]
+	commentCountCache *cache.Cache[int]
+	likeCountCache    *cache.Cache[int]
+	userCache         *cache.Cache[User]
+	userStatsCache    *cache.Cache[UserStats]
+
+	unreadNotificationCountCache *cache.Cache[int]
+)
+
+// 書き込み時に明示的に消すので、他のプロセスのLRUに古い値が残る時間だけ気にすればよい
+func initCaches() {
+	local := time.Second
+	postsCache = cache.New[[]Post](mc, cache.Options{TTL: 5 * time.Second, LocalSize: 16, LocalTTL: local})
+	commentsCache = cache.New[[]Comment](mc, cache.Options{TTL: 5 * time.Second, LocalSize: 10000, LocalTTL: local})
+	commentCountCache = cache.New[int](mc, cache.Options{TTL: 5 * time.Second, LocalSize: 10000, LocalTTL: local})
+	likeCountCache = cache.New[int](mc, cache.Options{TTL: 5 * time.Second, LocalSize: 10000, LocalTTL: local})
+	userCache = cache.New[User](mc, cache.Options{TTL: 30 * time.Second, LocalSize: 10000, LocalTTL: local})
+	userStatsCache = cache.New[UserStats](mc, cache.Options{TTL: 5 * time.Second, LocalSize: 1000, LocalTTL: local})
+	unreadNotificationCountCache = cache.New[int](mc, cache.Options{TTL: 5 * time.Second, LocalSize: 1000, LocalTTL: local})
+}
+
+func userCacheKey(userID int) string {
+	return "user_" + strconv.Itoa(userID)
+}
+
+func fetchUser(userID int) (User, error) {
+	return userCache.Fetch(userCacheKey(userID), func() (User, error) {
+		u := User{}
+		err := db.Get(&u, "SELECT * FROM `users` WHERE `id` = ?", userID)
+		return u, err
+	})
+}
+
+// 書き込んだ本人がすぐに結果を見られるように、影響するキャッシュを消す
+func invalidateIndexCache() {
+	err := postsCache.Delete(indexCacheKey)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// コメントが増えるとその投稿のコメント一覧・件数とタイムラインが変わる
+func invalidatePostCache(postID int) {
+	err := commentsCache.Delete(commentsCacheKey(postID, false), commentsCacheKey(postID, true))
+	if err != nil {
+		log.Print(err)
+	}
+	err = commentCountCache.Delete(commentCountCacheKey(postID))
+	if err != nil {
+		log.Print(err)
+	}
+	invalidateIndexCache()
+}
+
+// 投稿・コメントした本人と、コメントされた投稿の持ち主の件数が変わる
+func invalidateUserStatsCache(userIDs ...int) {
+	keys := make([]string, 0, len(userIDs))
+	for _, id := range userIDs {
+		keys = append(keys, userStatsCacheKey(id))
+	}
+	err := userStatsCache.Delete(keys...)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// いいねの数はその投稿とタイムラインに出る
+func invalidateLikeCache(postID int) {
+	err := likeCountCache.Delete(likeCountCacheKey(postID))
+	if err != nil {
+		log.Print(err)
+	}
+	invalidateIndexCache()
+}
+
+func invalidateUserCache(userID int) {
+	err := userCache.Delete(userCacheKey(userID))
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func commentsCacheKey(postID int, allComments bool) string {
+	key := "comment_" + strconv.Itoa(postID)
+	if allComments {
+		key += "_all"
+	}
+	return key
+}
+
+func commentCountCacheKey(postID int) string {
+	return "comment_count_" + strconv.Itoa(postID)
+}
+
+func likeCountCacheKey(postID int) string {
+	return "like_count_" + strconv.Itoa(postID)
+}
+
+// 古い順に並べたコメント。allCommentsでなければ最新3件
+func loadComments(postID int, allComments bool) ([]Comment, error) {
+	var comments []Comment
+	query := "SELECT `id`, `post_id`, `user_id`, `comment`, `created_at` FROM `comments` WHERE `post_id` = ? AND `hidden_at` IS NULL ORDER BY `created_at` DESC"
+	if !allComments {
+		query += " LIMIT 3"
+	}
+	err := db.Select(&comments, query, postID)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(comments); i++ {
+		comments[i].User, err = fetchUser(comments[i].UserID)
 		if err != nil {
-			query := "SELECT * FROM `comments` WHERE `post_id` = ? ORDER BY `created_at` DESC"
-			if !allComments {
-				query += " LIMIT 3"
-			}
-			err = db.Select(&comments, query, r.PostID)
-			if err != nil {
-				return nil, err
-			}
-			for i := 0; i < len(comments); i++ {
-				err := db.Get(&comments[i].User, "SELECT * FROM `users` WHERE `id` = ?", comments[i].UserID)
-				if err != nil {
-					return nil, err
-				}
-			}
-			for i, j := 0, len(comments)-1; i < j; i, j = i+1, j-1 {
-				comments[i], comments[j] = comments[j], comments[i]
-			}
-			setStructToMemcache(mc, key, comments)
+			return nil, err
 		}
+	}
+	for i, j := 0, len(comments)-1; i < j; i, j = i+1, j-1 {
+		comments[i], comments[j] = comments[j], comments[i]
+	}
+	return comments, nil
+}
+
+// 返すPostはキャッシュされうるのでCSRFTokenのようなリクエストごとの値は入れない
+// 描画直前にwithViewerで埋める
+func fastMakePosts(results []PostUser, allComments bool) ([]Post, error) {
+	postIDs := make(map[string]int, len(results)*2)
+	commentKeys := make([]string, 0, len(results))
+	countKeys := make([]string, 0, len(results))
+	likeKeys := make([]string, 0, len(results))
+	for _, r := range results {
+		commentKey := commentsCacheKey(r.PostID, allComments)
+		countKey := commentCountCacheKey(r.PostID)
+		likeKey := likeCountCacheKey(r.PostID)
+		postIDs[commentKey] = r.PostID
+		postIDs[countKey] = r.PostID
+		postIDs[likeKey] = r.PostID
+		commentKeys = append(commentKeys, commentKey)
+		countKeys = append(countKeys, countKey)
+		likeKeys = append(likeKeys, likeKey)
+	}
+
+	commentsByKey, err := commentsCache.FetchMulti(commentKeys, func(key string) ([]Comment, error) {
+		return loadComments(postIDs[key], allComments)
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		key = "comment_count_" + strconv.Itoa(r.PostID)
+	countsByKey, err := commentCountCache.FetchMulti(countKeys, func(key string) (int, error) {
 		var commentCount int
-		err = getStructFromMemcache(mc, key, &commentCount)
-		if err != nil {
-			err := db.Get(&commentCount, "SELECT COUNT(*) AS `count` FROM `comments` WHERE `post_id` = ?", r.PostID)
-			if err != nil {
-				return nil, err
-			}
-			setStructToMemcache(mc, key, commentCount)
-		}
-		r.PostCommentCount = commentCount
-
-		// err := db.Get(&r.PostCommentCount, "SELECT COUNT(*) AS `count` FROM `comments` WHERE `post_id` = ?", r.PostID)
-		// if err != nil {
-		// 	return nil, err
-		// }
-
-		// var comments []Comment
-		// query := "SELECT * FROM `comments` WHERE `post_id` = ? ORDER BY `created_at` DESC"
-		// if !allComments {
-		// 	query += " LIMIT 3"
-		// }
-		// err = db.Select(&comments, query, r.PostID)
-		// if err != nil {
-		// 	return nil, err
-		// }
+		err := db.Get(&commentCount, "SELECT COUNT(*) AS `count` FROM `comments` WHERE `post_id` = ? AND `hidden_at` IS NULL", postIDs[key])
+		return commentCount, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	likesByKey, err := likeCountCache.FetchMulti(likeKeys, func(key string) (int, error) {
+		var likeCount int
+		err := db.Get(&likeCount, "SELECT COUNT(*) AS `count` FROM `likes` WHERE `post_id` = ?", postIDs[key])
+		return likeCount, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var posts []Post
+	for _, r := range results {
+		comments := commentsByKey[commentsCacheKey(r.PostID, allComments)]
+		r.PostCommentCount = countsByKey[commentCountCacheKey(r.PostID)]
 
 		posts = append(posts, Post{
 			ID:           r.PostID,
@@ -307,6 +544,7 @@ func fastMakePosts(results []PostUser, csrfToken string, allComments bool) ([]Po
 			Mime:         r.PostMime,
 			CreatedAt:    r.PostCreatedAt,
 			CommentCount: r.PostCommentCount,
+			LikeCount:    likesByKey[likeCountCacheKey(r.PostID)],
 			Comments:     comments,
 			User: User{
 				ID:          r.PostUserID,
@@ -316,7 +554,6 @@ func fastMakePosts(results []PostUser, csrfToken string, allComments bool) ([]Po
 				DelFlg:      r.UserDelFlg,
 				CreatedAt:   r.UserCreatedAt,
 			},
-			CSRFToken: csrfToken,
 		})
 	}
 
@@ -375,16 +612,29 @@ func fastMakePosts(results []PostUser, csrfToken string, allComments bool) ([]Po
 // }
 
 func imageURL(p Post) string {
-	ext := ""
-	if p.Mime == "image/jpeg" {
-		ext = ".jpg"
-	} else if p.Mime == "image/png" {
-		ext = ".png"
-	} else if p.Mime == "image/gif" {
-		ext = ".gif"
+	return imageStore.URL(imagestore.Key{PostID: p.ID, Mime: p.Mime})
+}
+
+// 縮小版は初回リクエスト時にgetImageで作るので常にアプリ経由のURLにする
+func imageSrcset(p Post) string {
+	s := make([]string, 0, len(imagestore.VariantWidths))
+	for _, width := range imagestore.VariantWidths {
+		key := imagestore.Key{PostID: p.ID, Mime: p.Mime, Width: width}
+		s = append(s, imagestore.LocalURL(key)+" "+strconv.Itoa(width)+"w")
 	}
+	return strings.Join(s, ", ")
+}
 
-	return "/image/" + strconv.Itoa(p.ID) + ext
+// 投稿のContent-Typeからファイルのタイプを決定する
+func declaredMime(contentType string) string {
+	if strings.Contains(contentType, "jpeg") {
+		return "image/jpeg"
+	} else if strings.Contains(contentType, "png") {
+		return "image/png"
+	} else if strings.Contains(contentType, "gif") {
+		return "image/gif"
+	}
+	return ""
 }
 
 func isLogin(u User) bool {
@@ -400,6 +650,42 @@ func getCSRFToken(r *http.Request) string {
 	return csrfToken.(string)
 }
 
+// postsはキャッシュと共有しているのでコピーしてから埋める
+// 自分がいいねしたかどうかは表示する投稿の分だけまとめて引く
+func withViewer(posts []Post, csrfToken string, me User) ([]Post, error) {
+	ps := make([]Post, len(posts))
+	for i, p := range posts {
+		p.CSRFToken = csrfToken
+		ps[i] = p
+	}
+	if !isLogin(me) || len(ps) == 0 {
+		return ps, nil
+	}
+
+	postIDs := make([]int, len(ps))
+	for i, p := range ps {
+		postIDs[i] = p.ID
+	}
+	query, args, err := sqlx.In("SELECT `post_id` FROM `likes` WHERE `user_id` = ? AND `post_id` IN (?)", me.ID, postIDs)
+	if err != nil {
+		return nil, err
+	}
+	liked := []int{}
+	err = db.Select(&liked, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	likedSet := make(map[int]bool, len(liked))
+	for _, id := range liked {
+		likedSet[id] = true
+	}
+	for i := range ps {
+		ps[i].LikedByMe = likedSet[ps[i].ID]
+	}
+	return ps, nil
+}
+
 func secureRandomStr(b int) string {
 	k := make([]byte, b)
 	if _, err := crand.Read(k); err != nil {
@@ -412,23 +698,24 @@ func getTemplPath(filename string) string {
 	return path.Join("templates", filename)
 }
 
-func getInitialize(w http.ResponseWriter, r *http.Request) {
-	dbInitialize()
+func getInitialize(w http.ResponseWriter, r *http.Request) error {
+	err := dbInitialize()
+	if err != nil {
+		return err
+	}
 	w.WriteHeader(http.StatusOK)
+	return nil
 }
 
-func getLogin(w http.ResponseWriter, r *http.Request) {
+func getLogin(w http.ResponseWriter, r *http.Request) error {
 	me := getSessionUser(r)
 
 	if isLogin(me) {
 		http.Redirect(w, r, "/", http.StatusFound)
-		return
+		return nil
 	}
 
-	template.Must(template.ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("login.html")),
-	).Execute(w, struct {
+	return templates.Execute(w, "login", struct {
 		Me    User
 		Flash string
 	}{me, getFlash(w, r, "notice")})
@@ -458,25 +745,22 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getRegister(w http.ResponseWriter, r *http.Request) {
+func getRegister(w http.ResponseWriter, r *http.Request) error {
 	if isLogin(getSessionUser(r)) {
 		http.Redirect(w, r, "/", http.StatusFound)
-		return
+		return nil
 	}
 
-	template.Must(template.ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("register.html")),
-	).Execute(w, struct {
+	return templates.Execute(w, "register", struct {
 		Me    User
 		Flash string
 	}{User{}, getFlash(w, r, "notice")})
 }
 
-func postRegister(w http.ResponseWriter, r *http.Request) {
+func postRegister(w http.ResponseWriter, r *http.Request) error {
 	if isLogin(getSessionUser(r)) {
 		http.Redirect(w, r, "/", http.StatusFound)
-		return
+		return nil
 	}
 
 	accountName, password := r.FormValue("account_name"), r.FormValue("password")
@@ -488,7 +772,7 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		session.Save(r, w)
 
 		http.Redirect(w, r, "/register", http.StatusFound)
-		return
+		return nil
 	}
 
 	exists := 0
@@ -501,27 +785,31 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		session.Save(r, w)
 
 		http.Redirect(w, r, "/register", http.StatusFound)
-		return
+		return nil
+	}
+
+	passhash, err := hashPassword(password)
+	if err != nil {
+		return err
 	}
 
 	query := "INSERT INTO `users` (`account_name`, `passhash`) VALUES (?,?)"
-	result, err := db.Exec(query, accountName, calculatePasshash(accountName, password))
+	result, err := db.Exec(query, accountName, passhash)
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
 	session := getSession(r)
 	uid, err := result.LastInsertId()
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 	session.Values["user_id"] = uid
 	session.Values["csrf_token"] = secureRandomStr(16)
 	session.Save(r, w)
 
 	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
 }
 
 func getLogout(w http.ResponseWriter, r *http.Request) {
@@ -533,101 +821,7 @@ func getLogout(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-func getIndex(w http.ResponseWriter, r *http.Request) {
-	me := getSessionUser(r)
-
-	key := "index"
-	var posts []Post
-	err := getStructFromMemcache(mc, key, &posts)
-	if err != nil {
-		// results := []Post{}
-		// err := db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` ORDER BY `created_at` DESC")
-		// if err != nil {
-		// 	log.Print(err)
-		// 	return
-		// }
-		// posts, err = makePosts(results, getCSRFToken(r), false)
-		results := []PostUser{}
-		query := `
-		SELECT
-			posts.id AS post_id,
-			posts.user_id AS post_user_id,
-			posts.body AS post_body,
-			posts.mime AS post_mime,
-			posts.created_at AS post_created_at,
-			users.account_name AS user_account_name,
-			users.passhash AS user_passhash,
-			users.authority AS user_authority,
-			users.del_flg AS user_del_flg,
-			users.created_at AS user_created_at
-		FROM posts FORCE INDEX (created_at_index)
-		JOIN users
-		ON users.id = posts.user_id
-		WHERE users.del_flg = 0
-		ORDER BY posts.created_at DESC
-		LIMIT 20
-		`
-		err := db.Select(&results, query)
-		if err != nil {
-			log.Print(err)
-			return
-		}
-		posts, err = fastMakePosts(results, getCSRFToken(r), false)
-		if err != nil {
-			log.Print(err)
-			return
-		}
-		setStructToMemcache(mc, key, posts)
-	}
-
-	fmap := template.FuncMap{
-		"imageURL": imageURL,
-	}
-
-	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("index.html"),
-		getTemplPath("posts.html"),
-		getTemplPath("post.html"),
-	)).Execute(w, struct {
-		Posts     []Post
-		Me        User
-		CSRFToken string
-		Flash     string
-	}{posts, me, getCSRFToken(r), getFlash(w, r, "notice")})
-}
-
-func getAccountName(w http.ResponseWriter, r *http.Request) {
-	accountName := chi.URLParam(r, "accountName")
-	user := User{}
-
-	err := db.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
-	if err != nil {
-		log.Print(err)
-		return
-	}
-
-	if user.ID == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
-	// results := []Post{}
-
-	// err = db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `user_id` = ? ORDER BY `created_at` DESC", user.ID)
-	// if err != nil {
-	// 	log.Print(err)
-	// 	return
-	// }
-
-	// posts, err := makePosts(results, getCSRFToken(r), false)
-	// if err != nil {
-	// 	log.Print(err)
-	// 	return
-	// }
-
-	results := []PostUser{}
-	query := `
+const postUserSelect = `
 	SELECT
 		posts.id AS post_id,
 		posts.user_id AS post_user_id,
@@ -639,246 +833,373 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 		users.authority AS user_authority,
 		users.del_flg AS user_del_flg,
 		users.created_at AS user_created_at
-	FROM posts FORCE INDEX (user_id_created_at_index)
+`
+
+// タイムライン先頭のpostsPerPage件を取得する
+func fetchIndexPosts() ([]Post, error) {
+	return postsCache.Fetch(indexCacheKey, func() ([]Post, error) {
+		return fetchTimelinePosts(nil)
+	})
+}
+
+// cursorより後ろのpostsPerPage件を取得する。cursorがnilなら先頭から
+func fetchTimelinePosts(cursor *Cursor) ([]Post, error) {
+	cond, args := cursorCondition(cursor)
+
+	results := []PostUser{}
+	query := postUserSelect + `
+	FROM posts FORCE INDEX (created_at_index)
 	JOIN users
 	ON users.id = posts.user_id
 	WHERE users.del_flg = 0
-	AND posts.user_id = ?
-	ORDER BY posts.created_at DESC
-	LIMIT 20
+	AND posts.hidden_at IS NULL
+	` + cond + `
+	ORDER BY posts.created_at DESC, posts.id DESC
+	LIMIT ?
 	`
-	err = db.Select(&results, query, user.ID)
+	err := db.Select(&results, query, append(args, postsPerPage)...)
 	if err != nil {
-		log.Print(err)
-		return
+		return nil, err
 	}
 
-	posts, err := fastMakePosts(results, getCSRFToken(r), false)
-	if err != nil {
-		log.Print(err)
-		return
-	}
+	return fastMakePosts(results, false)
+}
 
-	commentCount := 0
-	err = db.Get(&commentCount, "SELECT COUNT(*) AS count FROM `comments` WHERE `user_id` = ?", user.ID)
-	if err != nil {
-		log.Print(err)
-		return
-	}
+// maxCreatedAt以前に投稿されたpostsPerPage件を取得する
+// 秒単位なので同時刻の投稿がページをまたぐと重複する。互換性のためだけに残している
+func fetchPostsBefore(maxCreatedAt time.Time) ([]Post, error) {
+	results := []PostUser{}
+	query := postUserSelect + `
+	FROM posts FORCE INDEX (created_at_index)
+	JOIN users
+	ON users.id = posts.user_id
+	WHERE users.del_flg = 0
+	AND posts.hidden_at IS NULL
+	AND posts.created_at <= ?
+	ORDER BY posts.created_at DESC, posts.id DESC
+	LIMIT ?
+	`
+	err := db.Select(&results, query, maxCreatedAt.Format(ISO8601Format), postsPerPage)
+	if err != nil {
+		return nil, err
+	}
+
+	return fastMakePosts(results, false)
+}
 
-	postIDs := []int{}
-	err = db.Select(&postIDs, "SELECT `id` FROM `posts` WHERE `user_id` = ?", user.ID)
+// 投稿が存在しない場合はnilを返す
+func fetchPost(pid int) (*Post, error) {
+	results := []PostUser{}
+	query := postUserSelect + `
+	FROM posts JOIN users
+	ON users.id = posts.user_id
+	WHERE posts.id = ?
+	AND posts.hidden_at IS NULL
+	`
+	err := db.Select(&results, query, pid)
 	if err != nil {
-		log.Print(err)
-		return
+		return nil, err
+	}
+	posts, err := fastMakePosts(results, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(posts) == 0 {
+		return nil, nil
+	}
+
+	return &posts[0], nil
+}
+
+func fetchUserPosts(userID int, cursor *Cursor) ([]Post, error) {
+	cond, args := cursorCondition(cursor)
+
+	results := []PostUser{}
+	query := postUserSelect + `
+	FROM posts FORCE INDEX (user_id_created_at_index)
+	JOIN users
+	ON users.id = posts.user_id
+	WHERE users.del_flg = 0
+	AND posts.hidden_at IS NULL
+	AND posts.user_id = ?
+	` + cond + `
+	ORDER BY posts.created_at DESC, posts.id DESC
+	LIMIT ?
+	`
+	args = append([]interface{}{userID}, args...)
+	err := db.Select(&results, query, append(args, postsPerPage)...)
+	if err != nil {
+		return nil, err
 	}
-	postCount := len(postIDs)
 
-	commentedCount := 0
-	if postCount > 0 {
-		s := []string{}
-		for range postIDs {
-			s = append(s, "?")
+	return fastMakePosts(results, false)
+}
+
+type UserStats struct {
+	PostCount      int
+	CommentCount   int
+	CommentedCount int
+	FollowerCount  int
+	FollowingCount int
+}
+
+func userStatsCacheKey(userID int) string {
+	return "user_stats_" + strconv.Itoa(userID)
+}
+
+// 件数はどれもインデックスだけで数えられるクエリにして、短い間キャッシュする
+func fetchUserStats(userID int) (UserStats, error) {
+	return userStatsCache.Fetch(userStatsCacheKey(userID), func() (UserStats, error) {
+		stats := UserStats{}
+
+		err := db.Get(&stats.PostCount, "SELECT COUNT(*) AS count FROM `posts` WHERE `user_id` = ? AND `hidden_at` IS NULL", userID)
+		if err != nil {
+			return stats, err
 		}
-		placeholder := strings.Join(s, ", ")
 
-		// convert []int -> []interface{}
-		args := make([]interface{}, len(postIDs))
-		for i, v := range postIDs {
-			args[i] = v
+		err = db.Get(&stats.CommentCount, "SELECT COUNT(*) AS count FROM `comments` WHERE `user_id` = ? AND `hidden_at` IS NULL", userID)
+		if err != nil {
+			return stats, err
 		}
 
-		err = db.Get(&commentedCount, "SELECT COUNT(*) AS count FROM `comments` WHERE `post_id` IN ("+placeholder+")", args...)
+		query := `
+		SELECT COUNT(*) AS count
+		FROM posts FORCE INDEX (user_id_created_at_index)
+		JOIN comments FORCE INDEX (post_id_index)
+		ON comments.post_id = posts.id
+		WHERE posts.user_id = ?
+		AND posts.hidden_at IS NULL
+		AND comments.hidden_at IS NULL
+		`
+		err = db.Get(&stats.CommentedCount, query, userID)
 		if err != nil {
-			log.Print(err)
-			return
+			return stats, err
 		}
-	}
 
+		// BANされたユーザーは一覧に出さないので件数にも含めない
+		query = "SELECT COUNT(*) AS count FROM `follows` JOIN `users` ON `users`.`id` = `follows`.`follower_id` WHERE `follows`.`followee_id` = ? AND `users`.`del_flg` = 0"
+		err = db.Get(&stats.FollowerCount, query, userID)
+		if err != nil {
+			return stats, err
+		}
+
+		query = "SELECT COUNT(*) AS count FROM `follows` JOIN `users` ON `users`.`id` = `follows`.`followee_id` WHERE `follows`.`follower_id` = ? AND `users`.`del_flg` = 0"
+		err = db.Get(&stats.FollowingCount, query, userID)
+		return stats, err
+	})
+}
+
+func fetchActiveUser(accountName string) (User, error) {
+	user := User{}
+	err := db.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
+
+	return user, err
+}
+
+func getIndex(w http.ResponseWriter, r *http.Request) error {
 	me := getSessionUser(r)
 
-	fmap := template.FuncMap{
-		"imageURL": imageURL,
+	posts, err := fetchIndexPosts()
+	if err != nil {
+		return err
+	}
+	posts, err = withViewer(posts, getCSRFToken(r), me)
+	if err != nil {
+		return err
+	}
+
+	return templates.Execute(w, "index", struct {
+		Posts     PostList
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{newPostList(posts, "/posts"), me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+// cursorパラメータがあれば次のページ
+func fetchAccountPosts(r *http.Request) (User, []Post, error) {
+	user, err := fetchActiveUser(chi.URLParam(r, "accountName"))
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, nil, notFoundError("ユーザーが見つかりません")
+	}
+	if err != nil {
+		return user, nil, err
+	}
+
+	var cursor *Cursor
+	if c := r.URL.Query().Get("cursor"); c != "" {
+		cursor, err = parseCursor(c)
+		if err != nil {
+			return user, nil, badRequestError("カーソルが不正です", err)
+		}
 	}
 
-	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("user.html"),
-		getTemplPath("posts.html"),
-		getTemplPath("post.html"),
-	)).Execute(w, struct {
-		Posts          []Post
-		User           User
-		PostCount      int
-		CommentCount   int
-		CommentedCount int
-		Me             User
-	}{posts, user, postCount, commentCount, commentedCount, me})
+	posts, err := fetchUserPosts(user.ID, cursor)
+	return user, posts, err
 }
 
-func getPosts(w http.ResponseWriter, r *http.Request) {
-	m, err := url.ParseQuery(r.URL.RawQuery)
+func getAccountName(w http.ResponseWriter, r *http.Request) error {
+	user, posts, err := fetchAccountPosts(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Print(err)
-		return
+		return err
 	}
-	maxCreatedAt := m.Get("max_created_at")
-	if maxCreatedAt == "" {
-		return
+
+	stats, err := fetchUserStats(user.ID)
+	if err != nil {
+		return err
 	}
 
-	t, err := time.Parse(ISO8601Format, maxCreatedAt)
+	me := getSessionUser(r)
+	posts, err = withViewer(posts, getCSRFToken(r), me)
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
-	// results := []Post{}
-	// err = db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `created_at` <= ? ORDER BY `created_at` DESC", t.Format(ISO8601Format))
-	// if err != nil {
-	// 	log.Print(err)
-	// 	return
-	// }
+	following := false
+	if isLogin(me) && me.ID != user.ID {
+		following, err = isFollowing(me.ID, user.ID)
+		if err != nil {
+			return err
+		}
+	}
 
-	// posts, err := makePosts(results, getCSRFToken(r), false)
-	// if err != nil {
-	// 	log.Print(err)
-	// 	return
-	// }
+	return templates.Execute(w, "user", struct {
+		Posts       PostList
+		User        User
+		Stats       UserStats
+		IsFollowing bool
+		Me          User
+		CSRFToken   string
+	}{newPostList(posts, accountURL(user.AccountName)+"/posts"), user, stats, following, me, getCSRFToken(r)})
+}
 
-	results := []PostUser{}
-	query := `
-	SELECT
-		posts.id AS post_id,
-		posts.user_id AS post_user_id,
-		posts.body AS post_body,
-		posts.mime AS post_mime,
-		posts.created_at AS post_created_at,
-		users.account_name AS user_account_name,
-		users.passhash AS user_passhash,
-		users.authority AS user_authority,
-		users.del_flg AS user_del_flg,
-		users.created_at AS user_created_at
-	FROM posts FORCE INDEX (created_at_index)
-	JOIN users
-	ON users.id = posts.user_id
-	WHERE users.del_flg = 0
-	AND posts.created_at <= ?
-	ORDER BY posts.created_at DESC
-	LIMIT 20
-	`
-	err = db.Select(&results, query, t.Format(ISO8601Format))
+// 一覧ページの「もっと見る」で読み込む断片。/posts と同じ形で返す
+// cursorより後のページをfetchで取得し、basePathを次のページのURLに使う
+func renderMorePosts(w http.ResponseWriter, r *http.Request, basePath string, fetch func(cursor *Cursor) ([]Post, error)) error {
+	c := r.URL.Query().Get("cursor")
+	if c == "" {
+		return badRequestError("cursorが必要です", nil)
+	}
+	cursor, err := parseCursor(c)
 	if err != nil {
-		log.Print(err)
-		return
+		return badRequestError("カーソルが不正です", err)
 	}
-	posts, err := fastMakePosts(results, getCSRFToken(r), false)
+
+	posts, err := fetch(cursor)
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
 	if len(posts) == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return notFoundError("これ以上の投稿はありません")
 	}
 
-	fmap := template.FuncMap{
-		"imageURL": imageURL,
+	posts, err = withViewer(posts, getCSRFToken(r), getSessionUser(r))
+	if err != nil {
+		return err
 	}
 
-	template.Must(template.New("posts.html").Funcs(fmap).ParseFiles(
-		getTemplPath("posts.html"),
-		getTemplPath("post.html"),
-	)).Execute(w, posts)
+	return templates.Execute(w, "posts", newPostList(posts, basePath))
 }
 
-func getPostsID(w http.ResponseWriter, r *http.Request) {
-	pidStr := chi.URLParam(r, "id")
-	pid, err := strconv.Atoi(pidStr)
+// プロフィールページの「もっと見る」
+func getAccountNamePosts(w http.ResponseWriter, r *http.Request) error {
+	user, err := fetchActiveUser(chi.URLParam(r, "accountName"))
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFoundError("ユーザーが見つかりません")
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return err
 	}
 
-	results := []PostUser{}
-	query := `
-	SELECT
-		posts.id AS post_id,
-		posts.user_id AS post_user_id,
-		posts.body AS post_body,
-		posts.mime AS post_mime,
-		posts.created_at AS post_created_at,
-		users.account_name AS user_account_name,
-		users.passhash AS user_passhash,
-		users.authority AS user_authority,
-		users.del_flg AS user_del_flg,
-		users.created_at AS user_created_at
-	FROM posts JOIN users
-	ON users.id = posts.user_id
-	WHERE posts.id = ?
-	ORDER BY posts.created_at DESC
-	LIMIT 20
-	`
+	return renderMorePosts(w, r, accountURL(user.AccountName)+"/posts", func(cursor *Cursor) ([]Post, error) {
+		return fetchUserPosts(user.ID, cursor)
+	})
+}
 
-	err = db.Select(&results, query, pid)
+func getPosts(w http.ResponseWriter, r *http.Request) error {
+	m, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
-		log.Print(err)
-		return
+		return err
+	}
+	var posts []Post
+	if c := m.Get("cursor"); c != "" {
+		cursor, err := parseCursor(c)
+		if err != nil {
+			return badRequestError("カーソルが不正です", err)
+		}
+
+		posts, err = fetchTimelinePosts(cursor)
+		if err != nil {
+			return err
+		}
+	} else {
+		// 旧形式。ベンチマーカーが使っているので残す
+		maxCreatedAt := m.Get("max_created_at")
+		if maxCreatedAt == "" {
+			return badRequestError("cursorかmax_created_atが必要です", nil)
+		}
+
+		t, err := time.Parse(ISO8601Format, maxCreatedAt)
+		if err != nil {
+			return badRequestError("max_created_atの形式が不正です", err)
+		}
+
+		posts, err = fetchPostsBefore(t)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(posts) == 0 {
+		return notFoundError("これ以上の投稿はありません")
 	}
-	posts, err := fastMakePosts(results, getCSRFToken(r), true)
+
+	posts, err = withViewer(posts, getCSRFToken(r), getSessionUser(r))
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
-	// results := []Post{}
-	// err = db.Select(&results, "SELECT * FROM `posts` WHERE `id` = ?", pid)
-	// if err != nil {
-	// 	log.Print(err)
-	// 	return
-	// }
+	return templates.Execute(w, "posts", newPostList(posts, "/posts"))
+}
 
-	// posts, err := makePosts(results, getCSRFToken(r), true)
-	// if err != nil {
-	// 	log.Print(err)
-	// 	return
-	// }
+func getPostsID(w http.ResponseWriter, r *http.Request) error {
+	pidStr := chi.URLParam(r, "id")
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil {
+		return notFoundError("投稿が見つかりません")
+	}
 
-	if len(posts) == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		return
+	p, err := fetchPost(pid)
+	if err != nil {
+		return err
 	}
 
-	p := posts[0]
+	if p == nil {
+		return notFoundError("投稿が見つかりません")
+	}
 
 	me := getSessionUser(r)
-
-	fmap := template.FuncMap{
-		"imageURL": imageURL,
+	posts, err := withViewer([]Post{*p}, getCSRFToken(r), me)
+	if err != nil {
+		return err
 	}
 
-	template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("post_id.html"),
-		getTemplPath("post.html"),
-	)).Execute(w, struct {
+	return templates.Execute(w, "post_id", struct {
 		Post Post
 		Me   User
-	}{p, me})
+	}{posts[0], me})
 }
 
-func postIndex(w http.ResponseWriter, r *http.Request) {
+func postIndex(w http.ResponseWriter, r *http.Request) error {
 	me := getSessionUser(r)
 	if !isLogin(me) {
 		http.Redirect(w, r, "/login", http.StatusFound)
-		return
+		return nil
 	}
 
 	if r.FormValue("csrf_token") != getCSRFToken(r) {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		return
+		return validationError("CSRFトークンが一致しません")
 	}
 
 	file, header, err := r.FormFile("file")
@@ -888,279 +1209,711 @@ func postIndex(w http.ResponseWriter, r *http.Request) {
 		session.Save(r, w)
 
 		http.Redirect(w, r, "/", http.StatusFound)
-		return
+		return nil
 	}
 
-	mime := ""
-	if file != nil {
-		// 投稿のContent-Typeからファイルのタイプを決定する
-		contentType := header.Header["Content-Type"][0]
-		if strings.Contains(contentType, "jpeg") {
-			mime = "image/jpeg"
-		} else if strings.Contains(contentType, "png") {
-			mime = "image/png"
-		} else if strings.Contains(contentType, "gif") {
-			mime = "image/gif"
-		} else {
-			session := getSession(r)
-			session.Values["notice"] = "投稿できる画像形式はjpgとpngとgifだけです"
-			session.Save(r, w)
+	filedata, err := io.ReadAll(io.LimitReader(file, UploadLimit+1))
+	if err != nil {
+		return err
+	}
 
-			http.Redirect(w, r, "/", http.StatusFound)
-			return
-		}
+	if len(filedata) > UploadLimit {
+		session := getSession(r)
+		session.Values["notice"] = "ファイルサイズが大きすぎます"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
 	}
 
-	filedata, err := io.ReadAll(file)
+	// Content-Typeは信用せず中身から形式を判定する
+	mime, err := imagestore.DetectMime(filedata)
 	if err != nil {
-		log.Print(err)
-		return
+		session := getSession(r)
+		if errors.Is(err, imagestore.ErrCorrupted) {
+			session.Values["notice"] = "画像を読み込めませんでした"
+		} else if errors.Is(err, imagestore.ErrTooLarge) {
+			session.Values["notice"] = "画像の縦横の大きさかフレーム数が大きすぎます"
+		} else {
+			session.Values["notice"] = "投稿できる画像形式はjpgとpngとgifだけです"
+		}
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
 	}
 
-	if len(filedata) > UploadLimit {
+	// Content-Typeが画像の形式を名乗っている場合は中身と一致しなければ受け付けない
+	// application/octet-streamのように形式を名乗らないものは、中身から判定した形式に任せる
+	contentType := strings.ToLower(strings.TrimSpace(header.Header.Get("Content-Type")))
+	if strings.HasPrefix(contentType, "image/") && declaredMime(contentType) != mime {
 		session := getSession(r)
-		session.Values["notice"] = "ファイルサイズが大きすぎます"
+		session.Values["notice"] = "画像の形式とContent-Typeが一致しません"
 		session.Save(r, w)
 
 		http.Redirect(w, r, "/", http.StatusFound)
-		return
+		return nil
 	}
 
-	query := "INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`) VALUES (?,?,?,?)"
+	// 画像本体はimageStoreに保存する
+	query := "INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`) VALUES (?,?,'',?)"
 	result, err := db.Exec(
 		query,
 		me.ID,
 		mime,
-		filedata,
 		r.FormValue("body"),
 	)
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
 	pid, err := result.LastInsertId()
 	if err != nil {
-		log.Print(err)
-		return
+		return err
+	}
+
+	err = imageStore.Put(r.Context(), imagestore.Key{PostID: int(pid), Mime: mime}, filedata)
+	if err != nil {
+		db.Exec("DELETE FROM `posts` WHERE `id` = ?", pid)
+		return err
+	}
+
+	err = saveTags(int(pid), r.FormValue("body"))
+	if err != nil {
+		return err
 	}
 
-	dumpImageFiles(pid, mime, filedata)
+	invalidateIndexCache()
+	invalidateUserStatsCache(me.ID)
 
 	http.Redirect(w, r, "/posts/"+strconv.FormatInt(pid, 10), http.StatusFound)
+	return nil
 }
 
-func getImage(w http.ResponseWriter, r *http.Request) {
+func getImage(w http.ResponseWriter, r *http.Request) error {
 	pidStr := chi.URLParam(r, "id")
 	pid, err := strconv.Atoi(pidStr)
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
+		return notFoundError("画像が見つかりません")
 	}
 
 	post := Post{}
-	err = db.Get(&post, "SELECT * FROM `posts` WHERE `id` = ?", pid)
+	// 非表示にした投稿の画像も返さない
+	err = db.Get(&post, "SELECT `id`, `mime` FROM `posts` WHERE `id` = ? AND `hidden_at` IS NULL", pid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFoundError("画像が見つかりません")
+	}
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
-	dumpImageFiles(int64(pid), post.Mime, post.Imgdata)
 
 	ext := chi.URLParam(r, "ext")
+	if ext != imagestore.Ext(post.Mime) {
+		return notFoundError("画像が見つかりません")
+	}
 
-	if ext == "jpg" && post.Mime == "image/jpeg" ||
-		ext == "png" && post.Mime == "image/png" ||
-		ext == "gif" && post.Mime == "image/gif" {
-		w.Header().Set("Content-Type", post.Mime)
-		_, err := w.Write(post.Imgdata)
-		if err != nil {
-			log.Print(err)
-			return
+	// /image/w{width}/{id}.{ext} は縮小版
+	key := imagestore.Key{PostID: post.ID, Mime: post.Mime}
+	if widthStr := chi.URLParam(r, "width"); widthStr != "" {
+		key.Width, err = strconv.Atoi(widthStr)
+		if err != nil || !imagestore.IsVariantWidth(key.Width) {
+			return notFoundError("画像が見つかりません")
 		}
-		return
 	}
 
-	w.WriteHeader(http.StatusNotFound)
-}
+	// 同じIDと幅の画像の中身は変わらないので、ブラウザに持っておいてもらう
+	etag := imageETag(key)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.Header().Set("Cache-Control", imageCacheControl)
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
 
-func postComment(w http.ResponseWriter, r *http.Request) {
+	imgdata, err := imageStore.Get(r.Context(), key)
+	if key.Width != 0 && errors.Is(err, imagestore.ErrNotFound) {
+		imgdata, err = makeImageVariant(key)
+	}
+	if errors.Is(err, imagestore.ErrNotFound) {
+		return notFoundError("画像が見つかりません")
+	}
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", post.Mime)
+	w.Header().Set("Cache-Control", imageCacheControl)
+	w.Header().Set("ETag", etag)
+	_, err = w.Write(imgdata)
+	return err
+}
+
+func postComment(w http.ResponseWriter, r *http.Request) error {
 	me := getSessionUser(r)
 	if !isLogin(me) {
 		http.Redirect(w, r, "/login", http.StatusFound)
-		return
+		return nil
 	}
 
 	if r.FormValue("csrf_token") != getCSRFToken(r) {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		return
+		return validationError("CSRFトークンが一致しません")
 	}
 
 	postID, err := strconv.Atoi(r.FormValue("post_id"))
 	if err != nil {
-		log.Print("post_idは整数のみです")
-		return
+		return validationError("post_idは整数のみです")
+	}
+
+	// 非表示にした投稿にはコメントさせない
+	postUserID := 0
+	err = db.Get(&postUserID, "SELECT `user_id` FROM `posts` WHERE `id` = ? AND `hidden_at` IS NULL", postID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFoundError("投稿が見つかりません")
+	}
+	if err != nil {
+		return err
 	}
 
 	query := "INSERT INTO `comments` (`post_id`, `user_id`, `comment`) VALUES (?,?,?)"
-	_, err = db.Exec(query, postID, me.ID, r.FormValue("comment"))
+	result, err := db.Exec(query, postID, me.ID, r.FormValue("comment"))
 	if err != nil {
-		log.Print(err)
-		return
+		return err
+	}
+
+	commentID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	err = notifyComment(me.ID, postID, postUserID, int(commentID), r.FormValue("comment"))
+	if err != nil {
+		return err
+	}
+
+	// コメント中のタグもコメント先の投稿に付ける
+	err = saveTags(postID, r.FormValue("comment"))
+	if err != nil {
+		return err
 	}
 
+	invalidatePostCache(postID)
+	invalidateUserStatsCache(me.ID, postUserID)
+
 	http.Redirect(w, r, fmt.Sprintf("/posts/%d", postID), http.StatusFound)
+	return nil
 }
 
-func getAdminBanned(w http.ResponseWriter, r *http.Request) {
+func getAdminBanned(w http.ResponseWriter, r *http.Request) error {
 	me := getSessionUser(r)
 	if !isLogin(me) {
 		http.Redirect(w, r, "/", http.StatusFound)
-		return
+		return nil
 	}
 
 	if me.Authority == 0 {
-		w.WriteHeader(http.StatusForbidden)
-		return
+		return forbiddenError("管理者のみアクセスできます")
 	}
 
 	users := []User{}
 	err := db.Select(&users, "SELECT * FROM `users` WHERE `authority` = 0 AND `del_flg` = 0 ORDER BY `created_at` DESC")
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
 
-	template.Must(template.ParseFiles(
-		getTemplPath("layout.html"),
-		getTemplPath("banned.html")),
-	).Execute(w, struct {
-		Users     []User
-		Me        User
-		CSRFToken string
-	}{users, me, getCSRFToken(r)})
+	bannedUsers := []User{}
+	err = db.Select(&bannedUsers, "SELECT * FROM `users` WHERE `authority` = 0 AND `del_flg` = 1 ORDER BY `created_at` DESC")
+	if err != nil {
+		return err
+	}
+
+	return templates.Execute(w, "banned", struct {
+		Users       []User
+		BannedUsers []User
+		Me          User
+		CSRFToken   string
+		Flash       string
+	}{users, bannedUsers, me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+func postAdminBanned(w http.ResponseWriter, r *http.Request) error {
+	return moderateUsers(w, r, moderationBan)
 }
 
-func postAdminBanned(w http.ResponseWriter, r *http.Request) {
+func postAdminUnbanned(w http.ResponseWriter, r *http.Request) error {
+	return moderateUsers(w, r, moderationUnban)
+}
+
+// BANとBAN解除。del_flgが実際に変わったユーザーだけ監査ログに残す
+func moderateUsers(w http.ResponseWriter, r *http.Request, action string) error {
 	me := getSessionUser(r)
 	if !isLogin(me) {
 		http.Redirect(w, r, "/", http.StatusFound)
-		return
+		return nil
 	}
 
 	if me.Authority == 0 {
-		w.WriteHeader(http.StatusForbidden)
-		return
+		return forbiddenError("管理者のみアクセスできます")
 	}
 
 	if r.FormValue("csrf_token") != getCSRFToken(r) {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		return
+		return validationError("CSRFトークンが一致しません")
 	}
 
-	query := "UPDATE `users` SET `del_flg` = ? WHERE `id` = ?"
-
 	err := r.ParseForm()
 	if err != nil {
-		log.Print(err)
-		return
+		return err
+	}
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if utf8.RuneCountInString(reason) > reasonMaxLength {
+		session := getSession(r)
+		session.Values["notice"] = fmt.Sprintf("理由は%d文字以内で入力してください", reasonMaxLength)
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/admin/banned", http.StatusFound)
+		return nil
 	}
 
+	delFlg := 1
+	if action == moderationUnban {
+		delFlg = 0
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	changed := []int{}
 	for _, id := range r.Form["uid[]"] {
-		db.Exec(query, 1, id)
+		uid, err := strconv.Atoi(id)
+		if err != nil {
+			continue
+		}
+
+		result, err := tx.Exec("UPDATE `users` SET `del_flg` = ? WHERE `id` = ? AND `authority` = 0 AND `del_flg` <> ?", delFlg, uid, delFlg)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+
+		_, err = tx.Exec("INSERT INTO `moderation_logs` (`admin_id`, `user_id`, `action`, `reason`) VALUES (?,?,?,?)", me.ID, uid, action, reason)
+		if err != nil {
+			return err
+		}
+		changed = append(changed, uid)
 	}
 
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	for _, uid := range changed {
+		invalidateUserCache(uid)
+	}
+	// BANされたユーザーの投稿をタイムラインからすぐに消す (解除したときはすぐに戻す)
+	invalidateIndexCache()
+
 	http.Redirect(w, r, "/admin/banned", http.StatusFound)
+	return nil
 }
 
-func getProfileStart(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Query().Get("path")
-	profiler = profile.Start(profile.ProfilePath(path))
-	w.WriteHeader(http.StatusOK)
-}
+func getAdminAudit(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
 
-func getProfileStop(w http.ResponseWriter, r *http.Request) {
-	profiler.Stop()
-	w.WriteHeader(http.StatusOK)
+	if me.Authority == 0 {
+		return forbiddenError("管理者のみアクセスできます")
+	}
+
+	logs := []ModerationLog{}
+	query := `
+	SELECT
+		l.*,
+		a.account_name AS admin_account_name,
+		u.account_name AS user_account_name
+	FROM moderation_logs l
+	JOIN users a ON a.id = l.admin_id
+	JOIN users u ON u.id = l.user_id
+	ORDER BY l.created_at DESC, l.id DESC
+	LIMIT ?
+	`
+	err := db.Select(&logs, query, moderationLogLimit)
+	if err != nil {
+		return err
+	}
+
+	return templates.Execute(w, "audit", struct {
+		Logs []ModerationLog
+		Me   User
+	}{logs, me})
 }
 
-func dumpImageFiles(pid int64, mime string, filedata []byte) {
-	var ext string
-	if mime == "image/jpeg" {
-		ext = "jpg"
-	} else if mime == "image/png" {
-		ext = "png"
-	} else if mime == "image/gif" {
-		ext = "gif"
+func getAdminHidden(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return forbiddenError("管理者のみアクセスできます")
 	}
-	path := fmt.Sprintf("../public/image/%d.%s", pid, ext)
 
-	err := os.WriteFile(path, filedata, 0666)
+	posts := []HiddenContent{}
+	query := `
+	SELECT p.id, p.id AS post_id, u.account_name, p.body, p.hidden_reason, p.hidden_at
+	FROM posts p JOIN users u ON u.id = p.user_id
+	WHERE p.hidden_at IS NOT NULL
+	ORDER BY p.hidden_at DESC
+	`
+	err := db.Select(&posts, query)
 	if err != nil {
-		log.Print(err)
-		return
+		return err
+	}
+
+	comments := []HiddenContent{}
+	query = `
+	SELECT c.id, c.post_id, u.account_name, c.comment AS body, c.hidden_reason, c.hidden_at
+	FROM comments c JOIN users u ON u.id = c.user_id
+	WHERE c.hidden_at IS NOT NULL
+	ORDER BY c.hidden_at DESC
+	`
+	err = db.Select(&comments, query)
+	if err != nil {
+		return err
 	}
+
+	return templates.Execute(w, "hidden", struct {
+		Posts     []HiddenContent
+		Comments  []HiddenContent
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{posts, comments, me, getCSRFToken(r), getFlash(w, r, "notice")})
 }
 
-func main() {
-	host := os.Getenv("ISUCONP_DB_HOST")
-	if host == "" {
-		host = "localhost"
+func postAdminHidePost(w http.ResponseWriter, r *http.Request) error {
+	return moderateContent(w, r, moderationHidePost)
+}
+
+func postAdminRestorePost(w http.ResponseWriter, r *http.Request) error {
+	return moderateContent(w, r, moderationRestorePost)
+}
+
+func postAdminHideComment(w http.ResponseWriter, r *http.Request) error {
+	return moderateContent(w, r, moderationHideComment)
+}
+
+func postAdminRestoreComment(w http.ResponseWriter, r *http.Request) error {
+	return moderateContent(w, r, moderationRestoreComment)
+}
+
+// 投稿・コメントの非表示と復元。理由は監査ログにも残す
+func moderateContent(w http.ResponseWriter, r *http.Request, action string) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return nil
+	}
+
+	if me.Authority == 0 {
+		return forbiddenError("管理者のみアクセスできます")
 	}
-	port := os.Getenv("ISUCONP_DB_PORT")
-	if port == "" {
-		port = "3306"
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		return validationError("CSRFトークンが一致しません")
 	}
-	_, err := strconv.Atoi(port)
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		log.Fatalf("Failed to read DB port number from an environment variable ISUCONP_DB_PORT.\nError: %s", err.Error())
+		return notFoundError("ページが見つかりません")
 	}
-	user := os.Getenv("ISUCONP_DB_USER")
-	if user == "" {
-		user = "root"
+
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if utf8.RuneCountInString(reason) > reasonMaxLength {
+		session := getSession(r)
+		session.Values["notice"] = fmt.Sprintf("理由は%d文字以内で入力してください", reasonMaxLength)
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/admin/hidden", http.StatusFound)
+		return nil
 	}
-	password := os.Getenv("ISUCONP_DB_PASSWORD")
-	dbname := os.Getenv("ISUCONP_DB_NAME")
-	if dbname == "" {
-		dbname = "isuconp"
+
+	table := "posts"
+	if action == moderationHideComment || action == moderationRestoreComment {
+		table = "comments"
+	}
+	update := "UPDATE `" + table + "` SET `hidden_at` = NOW(), `hidden_reason` = ? WHERE `id` = ? AND `hidden_at` IS NULL"
+	args := []interface{}{reason, id}
+	if action == moderationRestorePost || action == moderationRestoreComment {
+		update = "UPDATE `" + table + "` SET `hidden_at` = NULL, `hidden_reason` = '' WHERE `id` = ? AND `hidden_at` IS NOT NULL"
+		args = []interface{}{id}
 	}
 
-	dsn := fmt.Sprintf(
-		"%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=true&loc=Local&interpolateParams=true",
-		user,
-		password,
-		host,
-		port,
-		dbname,
-	)
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	db, err = sqlx.Open("mysql", dsn)
+	target := struct {
+		UserID     int    `db:"user_id"`
+		PostID     int    `db:"post_id"`
+		PostUserID int    `db:"post_user_id"`
+		Mime       string `db:"mime"`
+	}{}
+	if table == "posts" {
+		err = tx.Get(&target, "SELECT `user_id`, `id` AS `post_id`, `user_id` AS `post_user_id`, `mime` FROM `posts` WHERE `id` = ? FOR UPDATE", id)
+	} else {
+		err = tx.Get(&target, "SELECT c.user_id, c.post_id, p.user_id AS post_user_id FROM comments c JOIN posts p ON p.id = c.post_id WHERE c.id = ? FOR UPDATE", id)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFoundError("ページが見つかりません")
+	}
 	if err != nil {
-		log.Fatalf("Failed to connect to DB: %s.", err.Error())
+		return err
 	}
-	defer db.Close()
 
+	result, err := tx.Exec(update, args...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	// すでに非表示(復元済み)なら何もしない
+	if n > 0 {
+		_, err = tx.Exec("INSERT INTO `moderation_logs` (`admin_id`, `user_id`, `action`, `reason`, `content_id`) VALUES (?,?,?,?,?)", me.ID, target.UserID, action, reason, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	// 行ロックを持ったまま外部のストレージを待たないよう、画像はコミットしてから移す
+	if table == "posts" && n > 0 {
+		err = movePostImages(id, target.Mime, action == moderationHidePost)
+		if err != nil {
+			session := getSession(r)
+			session.Values["notice"] = "画像を移せませんでした。次に起動したときに移し直します"
+			session.Save(r, w)
+		}
+	}
+
+	if table == "posts" {
+		invalidateIndexCache()
+	} else {
+		invalidatePostCache(target.PostID)
+	}
+	invalidateUserStatsCache(target.UserID, target.PostUserID)
+
+	http.Redirect(w, r, "/admin/hidden", http.StatusFound)
+	return nil
+}
+
+func getProfileStart(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	profiler = profile.Start(profile.ProfilePath(path))
+	w.WriteHeader(http.StatusOK)
+}
+
+func getProfileStop(w http.ResponseWriter, r *http.Request) {
+	profiler.Stop()
+	w.WriteHeader(http.StatusOK)
+}
+
+func newRouter() *chi.Mux {
 	r := chi.NewRouter()
+	r.Use(metricsMiddleware)
 
-	r.Get("/initialize", getInitialize)
-	r.Get("/login", getLogin)
-	r.Post("/login", postLogin)
-	r.Get("/register", getRegister)
-	r.Post("/register", postRegister)
+	r.Get("/initialize", handle(getInitialize))
+	r.Get("/login", handle(getLogin))
+	r.With(rateLimit(loginRateLimit)).Post("/login", postLogin)
+	r.Get("/register", handle(getRegister))
+	r.With(rateLimit(registerRateLimit)).Post("/register", handle(postRegister))
 	r.Get("/logout", getLogout)
-	r.Get("/", getIndex)
-	r.Get("/posts", getPosts)
-	r.Get("/posts/{id}", getPostsID)
-	r.Post("/", postIndex)
-	r.Get("/image/{id}.{ext}", getImage)
-	r.Post("/comment", postComment)
-	r.Get("/admin/banned", getAdminBanned)
-	r.Post("/admin/banned", postAdminBanned)
-	r.Get(`/@{accountName:[a-zA-Z]+}`, getAccountName)
+	r.Get("/", handle(getIndex))
+	r.Get("/posts", handle(getPosts))
+	r.Get("/posts/{id}", handle(getPostsID))
+	r.With(rateLimit(postRateLimit)).Post("/", handle(postIndex))
+	r.Get("/image/{id}.{ext}", handle(getImage))
+	r.Get("/image/w{width}/{id}.{ext}", handle(getImage))
+	r.With(rateLimit(commentRateLimit)).Post("/comment", handle(postComment))
+	r.Post("/posts/{id}/like", handle(postLike))
+	r.Post("/posts/{id}/unlike", handle(postUnlike))
+	r.Get("/admin/banned", handle(getAdminBanned))
+	r.Post("/admin/banned", handle(postAdminBanned))
+	r.Post("/admin/unbanned", handle(postAdminUnbanned))
+	r.Get("/admin/audit", handle(getAdminAudit))
+	r.Get("/admin/hidden", handle(getAdminHidden))
+	r.Post("/admin/posts/{id}/hide", handle(postAdminHidePost))
+	r.Post("/admin/posts/{id}/restore", handle(postAdminRestorePost))
+	r.Post("/admin/comments/{id}/hide", handle(postAdminHideComment))
+	r.Post("/admin/comments/{id}/restore", handle(postAdminRestoreComment))
+	r.Get(accountRoute, handle(getAccountName))
+	r.Get(accountRoute+"/posts", handle(getAccountNamePosts))
+	r.Post(accountRoute+"/follow", handle(postFollow))
+	r.Post(accountRoute+"/unfollow", handle(postUnfollow))
+	r.Get(accountRoute+"/followers", handle(getFollowers))
+	r.Get(accountRoute+"/following", handle(getFollowing))
+	r.Get(accountRoute+"/feed.atom", handle(getAccountAtom))
+	r.Get(accountRoute+"/feed.rss", handle(getAccountRSS))
+	r.Get("/following", handle(getFollowingTimeline))
+	r.Get("/following/posts", handle(getFollowingTimelinePosts))
+	r.Get("/tags/{tag}", handle(getTag))
+	r.Get("/tags/{tag}/posts", handle(getTagPosts))
+	r.Get("/search", handle(getSearch))
+	r.Get("/search/posts", handle(getSearchPosts))
+	r.Get("/notifications", handle(getNotifications))
+	r.Get("/feed.atom", handle(getTimelineAtom))
+	r.Get("/feed.rss", handle(getTimelineRSS))
+	r.Mount("/api/v1", apiRouter())
 	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
 		http.FileServer(http.Dir("../public")).ServeHTTP(w, r)
 	})
+
+	return r
+}
+
+// メトリクスとプロファイラーは外に見せないので、別のアドレスで待ち受ける
+func newInternalRouter() *chi.Mux {
+	r := chi.NewRouter()
+
 	r.Get("/api/pprof/start", getProfileStart)
 	r.Get("/api/pprof/stop", getProfileStop)
+	r.Handle("/metrics", promhttp.Handler())
+
+	return r
+}
+
+func main() {
+	cfg, args, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err = sqlx.Open("mysql", cfg.DSN())
+	if err != nil {
+		log.Fatalf("Failed to connect to DB: %s.", err.Error())
+	}
+	defer db.Close()
+
+	mc = memcache.New(cfg.MemcachedAddress)
+	defer mc.Close()
+	store, err = newSessionStore(cfg, cfg.SessionStore)
+	if err != nil {
+		log.Fatalf("Failed to initialize session store: %s.", err.Error())
+	}
+	initCaches()
+
+	err = migrateSchema()
+	if err != nil {
+		log.Fatalf("Failed to migrate schema: %s.", err.Error())
+	}
+
+	if len(args) > 0 && args[0] == "migrate-images" {
+		err := migrateImages(cfg, args[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	imageStore, err = newImageStore(cfg, cfg.ImageStore)
+	if err != nil {
+		log.Fatalf("Failed to initialize image store: %s.", err.Error())
+	}
+
+	// リクエストを受ける前に済ませて、モデレーションと同時に移さないようにする
+	err = syncHiddenPostImages()
+	if err != nil {
+		log.Printf("Failed to sync hidden post images: %s.", err.Error())
+	}
 
-	log.Fatal(http.ListenAndServe(":8080", r))
+	templates, err = loadTemplates(cfg.TemplateReload)
+	if err != nil {
+		log.Fatalf("Failed to load templates: %s.", err.Error())
+	}
+
+	if cfg.RateLimit {
+		rateLimiter = ratelimit.New(mc, "ratelimit_")
+	}
+	realIPHeader = cfg.RealIPHeader
+	configureRateLimits(cfg)
+
+	registerMetrics()
+
+	r := newRouter()
+
+	srv := &http.Server{
+		Addr:         cfg.Addr,
+		Handler:      r,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	serverErr := make(chan error, 2)
+	go func() {
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	var internalSrv *http.Server
+	if cfg.InternalAddr != "" {
+		internalSrv = &http.Server{
+			Addr:         cfg.InternalAddr,
+			Handler:      newInternalRouter(),
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+			IdleTimeout:  cfg.IdleTimeout,
+		}
+		go func() {
+			serverErr <- internalSrv.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-serverErr:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+
+	// 処理中のリクエストが終わるのを待ってからDBとmemcachedを閉じる
+	log.Print("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Print(err)
+	}
+	if internalSrv != nil {
+		err = internalSrv.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+	if profiler != nil {
+		profiler.Stop()
+	}
 }
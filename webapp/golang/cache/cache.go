@@ -0,0 +1,291 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"golang.org/x/sync/singleflight"
+)
+
+var ErrCacheMiss = errors.New("cache: miss")
+
+type Options struct {
+	// memcachedでの有効期限
+	TTL time.Duration
+	// プロセス内LRUの件数と有効期限。LocalSizeが0ならLRUは使わない
+	// Deleteは他のプロセスのLRUまでは消せないので、LocalTTLは短くしておく
+	LocalSize int
+	LocalTTL  time.Duration
+}
+
+// プロセス内LRUとmemcachedの2段のキャッシュ
+// 値はgobでエンコードしてmemcachedに置く。Getで返した値は他のリクエストと共有されるので書き換えないこと
+type Cache[T any] struct {
+	mc    *memcache.Client
+	opts  Options
+	local *lru[T]
+	group singleflight.Group
+	stats stats
+}
+
+// 起動してからの累計。メトリクスとして公開する
+type Stats struct {
+	LocalHits  uint64
+	RemoteHits uint64
+	Misses     uint64
+}
+
+type stats struct {
+	localHits  atomic.Uint64
+	remoteHits atomic.Uint64
+	misses     atomic.Uint64
+}
+
+func New[T any](mc *memcache.Client, opts Options) *Cache[T] {
+	c := &Cache[T]{mc: mc, opts: opts}
+	if opts.LocalSize > 0 {
+		c.local = newLRU[T](opts.LocalSize)
+	}
+	return c
+}
+
+func (c *Cache[T]) Stats() Stats {
+	return Stats{
+		LocalHits:  c.stats.localHits.Load(),
+		RemoteHits: c.stats.remoteHits.Load(),
+		Misses:     c.stats.misses.Load(),
+	}
+}
+
+func (c *Cache[T]) Get(key string) (T, error) {
+	var zero T
+	now := time.Now()
+	if c.local != nil {
+		if v, ok := c.local.get(key, now); ok {
+			c.stats.localHits.Add(1)
+			return v, nil
+		}
+	}
+
+	item, err := c.mc.Get(key)
+	if errors.Is(err, memcache.ErrCacheMiss) || (err == nil && isTombstone(item)) {
+		c.stats.misses.Add(1)
+		return zero, ErrCacheMiss
+	}
+	if err != nil {
+		c.stats.misses.Add(1)
+		return zero, err
+	}
+
+	v, err := decode[T](item.Value)
+	if err != nil {
+		c.stats.misses.Add(1)
+		return zero, err
+	}
+	c.stats.remoteHits.Add(1)
+	c.setLocal(key, v, c.opts.TTL, now)
+	return v, nil
+}
+
+// 見つかったものだけを返す。memcachedへは1往復にまとめる
+func (c *Cache[T]) GetMulti(keys []string) (map[string]T, error) {
+	now := time.Now()
+	found := make(map[string]T, len(keys))
+	remote := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if c.local != nil {
+			if v, ok := c.local.get(key, now); ok {
+				c.stats.localHits.Add(1)
+				found[key] = v
+				continue
+			}
+		}
+		remote = append(remote, key)
+	}
+	if len(remote) == 0 {
+		return found, nil
+	}
+
+	items, err := c.mc.GetMulti(remote)
+	if err != nil {
+		c.stats.misses.Add(uint64(len(remote)))
+		return found, err
+	}
+	for key, item := range items {
+		if isTombstone(item) {
+			continue
+		}
+		v, err := decode[T](item.Value)
+		if err != nil {
+			continue
+		}
+		found[key] = v
+		c.setLocal(key, v, c.opts.TTL, now)
+	}
+	c.stats.remoteHits.Add(uint64(len(found) - (len(keys) - len(remote))))
+	c.stats.misses.Add(uint64(len(keys) - len(found)))
+	return found, nil
+}
+
+func (c *Cache[T]) Set(key string, v T) error {
+	return c.SetWithTTL(key, v, c.opts.TTL)
+}
+
+func (c *Cache[T]) SetWithTTL(key string, v T, ttl time.Duration) error {
+	b, err := encode(v)
+	if err != nil {
+		return err
+	}
+
+	c.setLocal(key, v, ttl, time.Now())
+	return c.mc.Set(&memcache.Item{
+		Key:        key,
+		Value:      b,
+		Expiration: expiration(ttl),
+	})
+}
+
+// 消す代わりに空の値 (墓石) で上書きする
+// 書き込みより前に読んだ値で埋めているfillは、墓石が書き換わったことに気づいて保存をやめる
+func (c *Cache[T]) Delete(keys ...string) error {
+	var firstErr error
+	for _, key := range keys {
+		if c.local != nil {
+			c.local.remove(key)
+		}
+		err := c.mc.Set(&memcache.Item{
+			Key:        key,
+			Value:      []byte{},
+			Expiration: expiration(c.opts.TTL),
+		})
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// gobでエンコードした値は空にならない
+func isTombstone(item *memcache.Item) bool {
+	return len(item.Value) == 0
+}
+
+// キャッシュになければfillで作って保存する
+// 同じキーへの同時のミスはまとめて1回だけfillを呼ぶ
+func (c *Cache[T]) Fetch(key string, fill func() (T, error)) (T, error) {
+	v, err := c.Get(key)
+	if err == nil {
+		return v, nil
+	}
+	return c.fill(key, fill)
+}
+
+func (c *Cache[T]) fill(key string, fill func() (T, error)) (T, error) {
+	r, err, _ := c.group.Do(key, func() (interface{}, error) {
+		// fillより前に読んでおき、保存するときにこの時点から変わっていないことを確かめる
+		prev, err := c.mc.Get(key)
+		if err != nil {
+			prev = nil
+		}
+		v, err := fill()
+		if err != nil {
+			return v, err
+		}
+		// 保存に失敗しても値は返す
+		c.setIfUnchanged(key, v, prev)
+		return v, nil
+	})
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return r.(T), nil
+}
+
+// prevがnilならまだ何もない場合だけ、そうでなければprevから書き換わっていない場合だけ保存する
+// 間にDeleteされていたら、vはその前の書き込みを反映していないかもしれないので捨てる
+func (c *Cache[T]) setIfUnchanged(key string, v T, prev *memcache.Item) error {
+	b, err := encode(v)
+	if err != nil {
+		return err
+	}
+
+	if prev == nil {
+		err = c.mc.Add(&memcache.Item{
+			Key:        key,
+			Value:      b,
+			Expiration: expiration(c.opts.TTL),
+		})
+	} else {
+		prev.Value = b
+		prev.Expiration = expiration(c.opts.TTL)
+		err = c.mc.CompareAndSwap(prev)
+	}
+	if errors.Is(err, memcache.ErrNotStored) || errors.Is(err, memcache.ErrCASConflict) {
+		return nil
+	}
+	c.setLocal(key, v, c.opts.TTL, time.Now())
+	return err
+}
+
+// GetMultiでまとめて取得し、なかったものだけFetchと同じ方法で埋める
+func (c *Cache[T]) FetchMulti(keys []string, fill func(key string) (T, error)) (map[string]T, error) {
+	found, err := c.GetMulti(keys)
+	if err != nil {
+		found = make(map[string]T, len(keys))
+	}
+
+	for _, key := range keys {
+		if _, ok := found[key]; ok {
+			continue
+		}
+		key := key
+		v, err := c.fill(key, func() (T, error) { return fill(key) })
+		if err != nil {
+			return nil, err
+		}
+		found[key] = v
+	}
+	return found, nil
+}
+
+func (c *Cache[T]) setLocal(key string, v T, ttl time.Duration, now time.Time) {
+	if c.local == nil {
+		return
+	}
+	if ttl <= 0 || c.opts.LocalTTL < ttl {
+		ttl = c.opts.LocalTTL
+	}
+	c.local.set(key, v, now.Add(ttl))
+}
+
+// memcachedの有効期限は秒単位。0は無期限になるので1秒未満は切り上げる
+func expiration(ttl time.Duration) int32 {
+	if ttl <= 0 {
+		return 0
+	}
+	sec := int32(ttl / time.Second)
+	if sec == 0 {
+		sec = 1
+	}
+	return sec
+}
+
+func encode(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func decode[T any](b []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v)
+	return v, err
+}
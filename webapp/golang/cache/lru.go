@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// プロセス内に持つ期限付きのLRU
+type lru[T any] struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry[T any] struct {
+	key      string
+	value    T
+	expireAt time.Time
+}
+
+func newLRU[T any](size int) *lru[T] {
+	return &lru[T]{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *lru[T]) get(key string, now time.Time) (T, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero T
+	e, ok := c.items[key]
+	if !ok {
+		return zero, false
+	}
+	entry := e.Value.(*lruEntry[T])
+	if now.After(entry.expireAt) {
+		c.ll.Remove(e)
+		delete(c.items, key)
+		return zero, false
+	}
+	c.ll.MoveToFront(e)
+	return entry.value, true
+}
+
+func (c *lru[T]) set(key string, value T, expireAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		entry := e.Value.(*lruEntry[T])
+		entry.value = value
+		entry.expireAt = expireAt
+		c.ll.MoveToFront(e)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&lruEntry[T]{key: key, value: value, expireAt: expireAt})
+	for c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry[T]).key)
+	}
+}
+
+func (c *lru[T]) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.ll.Remove(e)
+		delete(c.items, key)
+	}
+}
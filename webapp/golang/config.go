@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/catatsuy/private-isu/webapp/golang/imagestore"
+	"github.com/catatsuy/private-isu/webapp/golang/ratelimit"
+)
+
+type Config struct {
+	Addr string
+	// /metrics とプロファイラーを返すアドレス。空なら待ち受けない
+	InternalAddr string
+
+	DBHost     string
+	DBPort     int
+	DBUser     string
+	DBPassword string
+	DBName     string
+
+	MemcachedAddress string
+
+	// mysql (デフォルト), local, s3 のいずれか
+	ImageStore string
+	// 画像はすべてgetImageから返すので、nginxが直接配信するpublic/の外に置く
+	ImageDir string
+	S3       imagestore.S3Config
+
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+
+	// 開発用。テンプレートの変更を再起動なしで反映する
+	TemplateReload bool
+
+	// memcached (デフォルト), cookie, memory のいずれか
+	SessionStore string
+	// セッションの署名・暗号化に使う秘密鍵。カンマ区切りで、先頭以外は古いクッキーの検証にだけ使う
+	SessionSecrets string
+
+	// ログイン・登録・投稿・コメントの回数制限
+	// ベンチマーカーは1つのIPアドレスから大量に登録するので、デフォルトでは制限しない
+	RateLimit bool
+	// リバースプロキシが接続元のIPアドレスを入れるヘッダー (X-Real-IPなど)
+	RealIPHeader string
+	// ルートごとの制限。IPアドレスごとと、ログイン中またはログインしようとしているアカウントごと
+	LoginRateLimit          RateLimitSetting
+	LoginAccountRateLimit   RateLimitSetting
+	RegisterRateLimit       RateLimitSetting
+	PostRateLimit           RateLimitSetting
+	PostAccountRateLimit    RateLimitSetting
+	CommentRateLimit        RateLimitSetting
+	CommentAccountRateLimit RateLimitSetting
+}
+
+// 「1分あたりの回数:続けて使える回数」の形式で書く。0:0なら制限しない
+type RateLimitSetting struct {
+	PerMinute int
+	Burst     int
+}
+
+func (s *RateLimitSetting) String() string {
+	return strconv.Itoa(s.PerMinute) + ":" + strconv.Itoa(s.Burst)
+}
+
+func (s *RateLimitSetting) Set(v string) error {
+	n, burst, ok := strings.Cut(v, ":")
+	if !ok {
+		return errors.New("expected PER_MINUTE:BURST")
+	}
+	perMinute, err := strconv.Atoi(n)
+	if err != nil || perMinute < 0 {
+		return fmt.Errorf("invalid per-minute count %q", n)
+	}
+	b, err := strconv.Atoi(burst)
+	if err != nil || b < 0 {
+		return fmt.Errorf("invalid burst %q", burst)
+	}
+	s.PerMinute, s.Burst = perMinute, b
+	return nil
+}
+
+func (s RateLimitSetting) limit() ratelimit.Limit {
+	return ratelimit.PerMinute(s.PerMinute, s.Burst)
+}
+
+// 以前からソースに書かれていた鍵。既存のセッションを引き継ぐためにデフォルトとして残す
+const defaultSessionSecret = "sendagaya"
+
+func defaultConfig() Config {
+	return Config{
+		Addr:             ":8080",
+		InternalAddr:     "127.0.0.1:6060",
+		DBHost:           "localhost",
+		DBPort:           3306,
+		DBUser:           "root",
+		DBName:           "isuconp",
+		MemcachedAddress: "localhost:11211",
+		ImageStore:       "mysql",
+		ImageDir:         "../image",
+		SessionStore:     "memcached",
+		SessionSecrets:   defaultSessionSecret,
+		// 画像のアップロードとダウンロードがあるので短くしすぎない
+		ReadTimeout:     30 * time.Second,
+		WriteTimeout:    30 * time.Second,
+		IdleTimeout:     120 * time.Second,
+		ShutdownTimeout: 10 * time.Second,
+		// パスワードの総当たりを防ぐ。同じアカウントへの試行は特に絞る
+		LoginRateLimit:          RateLimitSetting{30, 30},
+		LoginAccountRateLimit:   RateLimitSetting{5, 10},
+		RegisterRateLimit:       RateLimitSetting{5, 10},
+		PostRateLimit:           RateLimitSetting{30, 30},
+		PostAccountRateLimit:    RateLimitSetting{10, 10},
+		CommentRateLimit:        RateLimitSetting{60, 60},
+		CommentAccountRateLimit: RateLimitSetting{20, 20},
+	}
+}
+
+func (c *Config) DSN() string {
+	return fmt.Sprintf(
+		"%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=true&loc=Local&interpolateParams=true",
+		c.DBUser,
+		c.DBPassword,
+		c.DBHost,
+		c.DBPort,
+		c.DBName,
+	)
+}
+
+// フラグ名と対応する環境変数名
+var configEnv = map[string]string{
+	"addr":              "ISUCONP_ADDR",
+	"internal-addr":     "ISUCONP_INTERNAL_ADDR",
+	"db-host":           "ISUCONP_DB_HOST",
+	"db-port":           "ISUCONP_DB_PORT",
+	"db-user":           "ISUCONP_DB_USER",
+	"db-password":       "ISUCONP_DB_PASSWORD",
+	"db-name":           "ISUCONP_DB_NAME",
+	"memcached-address": "ISUCONP_MEMCACHED_ADDRESS",
+	"image-store":       "ISUCONP_IMAGE_STORE",
+	"image-dir":         "ISUCONP_IMAGE_DIR",
+	"s3-endpoint":       "ISUCONP_S3_ENDPOINT",
+	"s3-region":         "ISUCONP_S3_REGION",
+	"s3-bucket":         "ISUCONP_S3_BUCKET",
+	"s3-access-key":     "ISUCONP_S3_ACCESS_KEY",
+	"s3-secret-key":     "ISUCONP_S3_SECRET_KEY",
+	"s3-public-url":     "ISUCONP_S3_PUBLIC_URL",
+	"read-timeout":      "ISUCONP_READ_TIMEOUT",
+	"write-timeout":     "ISUCONP_WRITE_TIMEOUT",
+	"idle-timeout":      "ISUCONP_IDLE_TIMEOUT",
+	"shutdown-timeout":  "ISUCONP_SHUTDOWN_TIMEOUT",
+	"template-reload":   "ISUCONP_TEMPLATE_RELOAD",
+	"session-store":     "ISUCONP_SESSION_STORE",
+	"session-secrets":   "ISUCONP_SESSION_SECRETS",
+	"rate-limit":        "ISUCONP_RATE_LIMIT",
+	"real-ip-header":    "ISUCONP_REAL_IP_HEADER",
+
+	"rate-limit-login":           "ISUCONP_RATE_LIMIT_LOGIN",
+	"rate-limit-login-account":   "ISUCONP_RATE_LIMIT_LOGIN_ACCOUNT",
+	"rate-limit-register":        "ISUCONP_RATE_LIMIT_REGISTER",
+	"rate-limit-post":            "ISUCONP_RATE_LIMIT_POST",
+	"rate-limit-post-account":    "ISUCONP_RATE_LIMIT_POST_ACCOUNT",
+	"rate-limit-comment":         "ISUCONP_RATE_LIMIT_COMMENT",
+	"rate-limit-comment-account": "ISUCONP_RATE_LIMIT_COMMENT_ACCOUNT",
+}
+
+// デフォルト < 設定ファイル < 環境変数 < フラグ の順に上書きする
+// 設定ファイルはenv.shと同じ KEY=VALUE 形式で、キーは環境変数名
+// フラグ以外の残りの引数 (migrate-images などのサブコマンド) を一緒に返す
+func loadConfig(args []string) (*Config, []string, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("isuconp", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("ISUCONP_CONFIG"), "path to a KEY=VALUE config file (ISUCONP_CONFIG)")
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "listen address")
+	fs.StringVar(&cfg.InternalAddr, "internal-addr", cfg.InternalAddr, "listen address for /metrics and the profiler; empty to disable")
+	fs.StringVar(&cfg.DBHost, "db-host", cfg.DBHost, "MySQL host")
+	fs.IntVar(&cfg.DBPort, "db-port", cfg.DBPort, "MySQL port")
+	fs.StringVar(&cfg.DBUser, "db-user", cfg.DBUser, "MySQL user")
+	fs.StringVar(&cfg.DBPassword, "db-password", cfg.DBPassword, "MySQL password")
+	fs.StringVar(&cfg.DBName, "db-name", cfg.DBName, "MySQL database name")
+	fs.StringVar(&cfg.MemcachedAddress, "memcached-address", cfg.MemcachedAddress, "memcached address")
+	fs.StringVar(&cfg.ImageStore, "image-store", cfg.ImageStore, "image store (mysql, local, s3)")
+	fs.StringVar(&cfg.ImageDir, "image-dir", cfg.ImageDir, "directory for the local image store")
+	fs.StringVar(&cfg.S3.Endpoint, "s3-endpoint", cfg.S3.Endpoint, "S3 endpoint URL")
+	fs.StringVar(&cfg.S3.Region, "s3-region", cfg.S3.Region, "S3 region")
+	fs.StringVar(&cfg.S3.Bucket, "s3-bucket", cfg.S3.Bucket, "S3 bucket")
+	fs.StringVar(&cfg.S3.AccessKey, "s3-access-key", cfg.S3.AccessKey, "S3 access key")
+	fs.StringVar(&cfg.S3.SecretKey, "s3-secret-key", cfg.S3.SecretKey, "S3 secret key")
+	fs.StringVar(&cfg.S3.PublicURL, "s3-public-url", cfg.S3.PublicURL, "public base URL of the S3 bucket")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", cfg.ReadTimeout, "HTTP server read timeout")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", cfg.WriteTimeout, "HTTP server write timeout")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", cfg.IdleTimeout, "HTTP server idle timeout")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "time to wait for in-flight requests on shutdown")
+	fs.BoolVar(&cfg.TemplateReload, "template-reload", cfg.TemplateReload, "re-parse templates when the files change (development only)")
+	fs.StringVar(&cfg.SessionStore, "session-store", cfg.SessionStore, "session store (memcached, cookie, memory)")
+	fs.StringVar(&cfg.SessionSecrets, "session-secrets", cfg.SessionSecrets, "comma-separated session secrets; the first signs new sessions, the rest are accepted for rotation")
+	fs.BoolVar(&cfg.RateLimit, "rate-limit", cfg.RateLimit, "limit login, registration, posting and commenting per IP and account")
+	fs.StringVar(&cfg.RealIPHeader, "real-ip-header", cfg.RealIPHeader, "header set by the reverse proxy with the client IP (e.g. X-Real-IP)")
+	fs.Var(&cfg.LoginRateLimit, "rate-limit-login", "login attempts per IP as PER_MINUTE:BURST")
+	fs.Var(&cfg.LoginAccountRateLimit, "rate-limit-login-account", "login attempts per account name as PER_MINUTE:BURST")
+	fs.Var(&cfg.RegisterRateLimit, "rate-limit-register", "registrations per IP as PER_MINUTE:BURST")
+	fs.Var(&cfg.PostRateLimit, "rate-limit-post", "posts per IP as PER_MINUTE:BURST")
+	fs.Var(&cfg.PostAccountRateLimit, "rate-limit-post-account", "posts per user as PER_MINUTE:BURST")
+	fs.Var(&cfg.CommentRateLimit, "rate-limit-comment", "comments per IP as PER_MINUTE:BURST")
+	fs.Var(&cfg.CommentAccountRateLimit, "rate-limit-comment-account", "comments per user as PER_MINUTE:BURST")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 設定ファイルの場所はフラグで決まるので、一度パースしてからデフォルトに戻して積み直す
+	// フラグの値はfs.Setで同じフィールドに書き込まれる
+	explicit := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	cfg = defaultConfig()
+
+	if *configPath != "" {
+		values, err := readConfigFile(*configPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		warnUnknownConfigKeys(*configPath, values)
+		for name, env := range configEnv {
+			if v, ok := values[env]; ok {
+				err := fs.Set(name, v)
+				if err != nil {
+					return nil, nil, fmt.Errorf("%s: %s: %w", *configPath, env, err)
+				}
+			}
+		}
+	}
+
+	for name, env := range configEnv {
+		if v, ok := os.LookupEnv(env); ok && v != "" {
+			err := fs.Set(name, v)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", env, err)
+			}
+		}
+	}
+
+	for name, v := range explicit {
+		if name == "config" {
+			continue
+		}
+		fs.Set(name, v)
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &cfg, fs.Args(), nil
+}
+
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, line)
+		}
+		values[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+	return values, scanner.Err()
+}
+
+// env.shにはPATHなど他のプログラム向けの変数もあるので、ISUCONP_で始まらないキーは読み飛ばす
+// ISUCONP_で始まるのに知らないキーは綴りの間違いかもしれないので警告する
+func warnUnknownConfigKeys(path string, values map[string]string) {
+	known := make(map[string]bool, len(configEnv))
+	for _, env := range configEnv {
+		known[env] = true
+	}
+
+	var unknown []string
+	for key := range values {
+		if strings.HasPrefix(key, "ISUCONP_") && !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		log.Printf("%s: ignoring unknown keys: %s", path, strings.Join(unknown, ", "))
+	}
+}
+
+// 起動時にまとめて報告できるよう、問題はすべて集めて返す
+func (c *Config) validate() error {
+	var problems []string
+
+	if c.Addr == "" {
+		problems = append(problems, "addr must not be empty")
+	}
+	if c.DBHost == "" {
+		problems = append(problems, "db-host must not be empty")
+	}
+	if c.DBPort <= 0 || c.DBPort > 65535 {
+		problems = append(problems, fmt.Sprintf("db-port %d is out of range", c.DBPort))
+	}
+	if c.DBUser == "" {
+		problems = append(problems, "db-user must not be empty")
+	}
+	if c.DBName == "" {
+		problems = append(problems, "db-name must not be empty")
+	}
+	if c.MemcachedAddress == "" {
+		problems = append(problems, "memcached-address must not be empty")
+	}
+
+	switch c.ImageStore {
+	case "mysql":
+	case "local":
+		if c.ImageDir == "" {
+			problems = append(problems, "image-dir is required for the local image store")
+		}
+	case "s3":
+		if c.S3.Endpoint == "" || c.S3.Bucket == "" {
+			problems = append(problems, "s3-endpoint and s3-bucket are required for the s3 image store")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown image-store %q", c.ImageStore))
+	}
+
+	secrets := splitSecrets(c.SessionSecrets)
+	if len(secrets) == 0 {
+		problems = append(problems, "session-secrets must not be empty")
+	}
+	switch c.SessionStore {
+	case "memcached", "memory":
+	case "cookie":
+		// クッキーに中身を入れるので、公開されている鍵のままだとセッションを偽造できる
+		if len(secrets) > 0 && secrets[0] == defaultSessionSecret {
+			problems = append(problems, "session-secrets must be changed from the default for the cookie session store")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown session-store %q", c.SessionStore))
+	}
+
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"read-timeout", c.ReadTimeout},
+		{"write-timeout", c.WriteTimeout},
+		{"idle-timeout", c.IdleTimeout},
+		{"shutdown-timeout", c.ShutdownTimeout},
+	} {
+		if d.value <= 0 {
+			problems = append(problems, fmt.Sprintf("%s must be positive", d.name))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// エントリーのタイトルにする本文の長さ
+const feedTitleLength = 50
+
+// Atom (RFC 4287)。コメント数はAtom Threading Extension (RFC 4685) の thr:total で出す
+type atomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	Thr     string      `xml:"xmlns:thr,attr"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID           string     `xml:"id"`
+	Title        string     `xml:"title"`
+	Published    string     `xml:"published"`
+	Updated      string     `xml:"updated"`
+	Author       atomAuthor `xml:"author"`
+	Links        []atomLink `xml:"link"`
+	Content      string     `xml:"content"`
+	CommentCount int        `xml:"thr:total"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri"`
+}
+
+// RSS 2.0。コメント数はslash:commentsで出す
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Slash   string     `xml:"xmlns:slash,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title        string       `xml:"title"`
+	Link         string       `xml:"link"`
+	GUID         rssGUID      `xml:"guid"`
+	PubDate      string       `xml:"pubDate"`
+	Description  string       `xml:"description"`
+	Enclosure    rssEnclosure `xml:"enclosure"`
+	CommentCount int          `xml:"slash:comments"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// 画像の大きさは取得しないので、lengthは書かない
+type rssEnclosure struct {
+	URL  string `xml:"url,attr"`
+	Type string `xml:"type,attr"`
+}
+
+// フィード1本分。AtomとRSSはここから組み立てる
+type feed struct {
+	Title   string
+	Link    string // HTML版のページ
+	Self    string // フィード自身
+	Updated time.Time
+	Posts   []Post
+}
+
+// 投稿は編集できないので、最後にコメントされた時刻を更新日時とする
+func postUpdatedAt(p Post) time.Time {
+	updated := p.CreatedAt
+	for _, c := range p.Comments {
+		if c.CreatedAt.After(updated) {
+			updated = c.CreatedAt
+		}
+	}
+	return updated
+}
+
+func newFeed(title, link, self string, posts []Post) feed {
+	f := feed{Title: title, Link: link, Self: self, Posts: posts}
+	for _, p := range posts {
+		if u := postUpdatedAt(p); u.After(f.Updated) {
+			f.Updated = u
+		}
+	}
+	return f
+}
+
+func feedEntryTitle(p Post) string {
+	if p.Body == "" {
+		return "投稿 #" + strconv.Itoa(p.ID)
+	}
+	if utf8.RuneCountInString(p.Body) <= feedTitleLength {
+		return p.Body
+	}
+	return string([]rune(p.Body)[:feedTitleLength]) + "…"
+}
+
+// フィードには絶対URLを書く
+func absoluteURL(r *http.Request, ref string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	base := &url.URL{Scheme: scheme, Host: r.Host, Path: "/"}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return base.ResolveReference(u).String()
+}
+
+func (f feed) atom(r *http.Request) atomFeed {
+	a := atomFeed{
+		Xmlns:   "http://www.w3.org/2005/Atom",
+		Thr:     "http://purl.org/syndication/thread/1.0",
+		ID:      absoluteURL(r, f.Link),
+		Title:   f.Title,
+		Updated: f.Updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: absoluteURL(r, f.Self)},
+			{Rel: "alternate", Type: "text/html", Href: absoluteURL(r, f.Link)},
+		},
+		Entries: make([]atomEntry, 0, len(f.Posts)),
+	}
+	for _, p := range f.Posts {
+		link := absoluteURL(r, "/posts/"+strconv.Itoa(p.ID))
+		a.Entries = append(a.Entries, atomEntry{
+			ID:        link,
+			Title:     feedEntryTitle(p),
+			Published: p.CreatedAt.UTC().Format(time.RFC3339),
+			Updated:   postUpdatedAt(p).UTC().Format(time.RFC3339),
+			Author:    atomAuthor{Name: p.User.AccountName, URI: absoluteURL(r, accountURL(p.User.AccountName))},
+			Links: []atomLink{
+				{Rel: "alternate", Type: "text/html", Href: link},
+				{Rel: "enclosure", Type: p.Mime, Href: absoluteURL(r, imageURL(p))},
+			},
+			Content:      p.Body,
+			CommentCount: p.CommentCount,
+		})
+	}
+	return a
+}
+
+func (f feed) rss(r *http.Request) rssFeed {
+	ch := rssChannel{
+		Title:         f.Title,
+		Link:          absoluteURL(r, f.Link),
+		Description:   f.Title,
+		LastBuildDate: f.Updated.UTC().Format(time.RFC1123Z),
+		Items:         make([]rssItem, 0, len(f.Posts)),
+	}
+	for _, p := range f.Posts {
+		link := absoluteURL(r, "/posts/"+strconv.Itoa(p.ID))
+		ch.Items = append(ch.Items, rssItem{
+			Title:        feedEntryTitle(p),
+			Link:         link,
+			GUID:         rssGUID{IsPermaLink: true, Value: link},
+			PubDate:      p.CreatedAt.UTC().Format(time.RFC1123Z),
+			Description:  p.Body,
+			Enclosure:    rssEnclosure{URL: absoluteURL(r, imageURL(p)), Type: p.Mime},
+			CommentCount: p.CommentCount,
+		})
+	}
+	return rssFeed{Version: "2.0", Slash: "http://purl.org/rss/1.0/modules/slash/", Channel: ch}
+}
+
+// 中身のハッシュをETagにし、If-None-Matchの判定はServeContentに任せる
+// 投稿やコメントを非表示にしても更新日時は進まないので、Last-Modifiedは付けない
+func writeFeed(w http.ResponseWriter, r *http.Request, contentType string, v interface{}) error {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	err := xml.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+	return nil
+}
+
+func fetchTimelineFeed() (feed, error) {
+	posts, err := fetchIndexPosts()
+	if err != nil {
+		return feed{}, err
+	}
+	return newFeed("Iscogram", "/", "/feed.atom", posts), nil
+}
+
+func fetchAccountFeed(r *http.Request) (feed, error) {
+	user, err := fetchActiveUser(chi.URLParam(r, "accountName"))
+	if errors.Is(err, sql.ErrNoRows) {
+		return feed{}, notFoundError("ユーザーが見つかりません")
+	}
+	if err != nil {
+		return feed{}, err
+	}
+
+	posts, err := fetchUserPosts(user.ID, nil)
+	if err != nil {
+		return feed{}, err
+	}
+	return newFeed(user.AccountName+" - Iscogram", accountURL(user.AccountName), accountURL(user.AccountName)+"/feed.atom", posts), nil
+}
+
+func getTimelineAtom(w http.ResponseWriter, r *http.Request) error {
+	f, err := fetchTimelineFeed()
+	if err != nil {
+		return err
+	}
+	return writeFeed(w, r, "application/atom+xml; charset=utf-8", f.atom(r))
+}
+
+func getTimelineRSS(w http.ResponseWriter, r *http.Request) error {
+	f, err := fetchTimelineFeed()
+	if err != nil {
+		return err
+	}
+	return writeFeed(w, r, "application/rss+xml; charset=utf-8", f.rss(r))
+}
+
+func getAccountAtom(w http.ResponseWriter, r *http.Request) error {
+	f, err := fetchAccountFeed(r)
+	if err != nil {
+		return err
+	}
+	return writeFeed(w, r, "application/atom+xml; charset=utf-8", f.atom(r))
+}
+
+func getAccountRSS(w http.ResponseWriter, r *http.Request) error {
+	f, err := fetchAccountFeed(r)
+	if err != nil {
+		return err
+	}
+	return writeFeed(w, r, "application/rss+xml; charset=utf-8", f.rss(r))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func isFollowing(followerID, followeeID int) (bool, error) {
+	exists := 0
+	err := db.Get(&exists, "SELECT 1 FROM `follows` WHERE `follower_id` = ? AND `followee_id` = ?", followerID, followeeID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// フォローしているユーザーの投稿。BANされたユーザーと非表示の投稿は含めない
+func fetchFollowingPosts(userID int, cursor *Cursor) ([]Post, error) {
+	cond, args := cursorCondition(cursor)
+
+	results := []PostUser{}
+	query := postUserSelect + `
+	FROM follows
+	JOIN posts FORCE INDEX (user_id_created_at_index)
+	ON posts.user_id = follows.followee_id
+	JOIN users
+	ON users.id = posts.user_id
+	WHERE follows.follower_id = ?
+	AND users.del_flg = 0
+	AND posts.hidden_at IS NULL
+	` + cond + `
+	ORDER BY posts.created_at DESC, posts.id DESC
+	LIMIT ?
+	`
+	args = append([]interface{}{userID}, args...)
+	err := db.Select(&results, query, append(args, postsPerPage)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return fastMakePosts(results, false)
+}
+
+// フォロワー一覧 (followers) とフォロー中一覧 (following)。新しくフォローした順
+func fetchFollowers(userID int) ([]User, error) {
+	users := []User{}
+	query := "SELECT `users`.* FROM `follows` JOIN `users` ON `users`.`id` = `follows`.`follower_id` " +
+		"WHERE `follows`.`followee_id` = ? AND `users`.`del_flg` = 0 ORDER BY `follows`.`created_at` DESC"
+	err := db.Select(&users, query, userID)
+	return users, err
+}
+
+func fetchFollowees(userID int) ([]User, error) {
+	users := []User{}
+	query := "SELECT `users`.* FROM `follows` JOIN `users` ON `users`.`id` = `follows`.`followee_id` " +
+		"WHERE `follows`.`follower_id` = ? AND `users`.`del_flg` = 0 ORDER BY `follows`.`created_at` DESC"
+	err := db.Select(&users, query, userID)
+	return users, err
+}
+
+func postFollow(w http.ResponseWriter, r *http.Request) error {
+	return changeFollow(w, r, true)
+}
+
+func postUnfollow(w http.ResponseWriter, r *http.Request) error {
+	return changeFollow(w, r, false)
+}
+
+func changeFollow(w http.ResponseWriter, r *http.Request, follow bool) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		return validationError("CSRFトークンが一致しません")
+	}
+
+	user, err := fetchActiveUser(chi.URLParam(r, "accountName"))
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFoundError("ユーザーが見つかりません")
+	}
+	if err != nil {
+		return err
+	}
+
+	if user.ID == me.ID {
+		return validationError("自分自身はフォローできません")
+	}
+
+	if follow {
+		_, err = db.Exec("INSERT IGNORE INTO `follows` (`follower_id`, `followee_id`) VALUES (?,?)", me.ID, user.ID)
+	} else {
+		_, err = db.Exec("DELETE FROM `follows` WHERE `follower_id` = ? AND `followee_id` = ?", me.ID, user.ID)
+	}
+	if err != nil {
+		return err
+	}
+
+	invalidateUserStatsCache(me.ID, user.ID)
+
+	http.Redirect(w, r, accountURL(user.AccountName), http.StatusFound)
+	return nil
+}
+
+func getFollowers(w http.ResponseWriter, r *http.Request) error {
+	return renderFollows(w, r, "フォロワー", fetchFollowers)
+}
+
+func getFollowing(w http.ResponseWriter, r *http.Request) error {
+	return renderFollows(w, r, "フォロー中", fetchFollowees)
+}
+
+func renderFollows(w http.ResponseWriter, r *http.Request, title string, fetch func(userID int) ([]User, error)) error {
+	user, err := fetchActiveUser(chi.URLParam(r, "accountName"))
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFoundError("ユーザーが見つかりません")
+	}
+	if err != nil {
+		return err
+	}
+
+	users, err := fetch(user.ID)
+	if err != nil {
+		return err
+	}
+
+	return templates.Execute(w, "follows", struct {
+		Title string
+		User  User
+		Users []User
+		Me    User
+	}{title, user, users, getSessionUser(r)})
+}
+
+// フォローしているユーザーのタイムライン
+func getFollowingTimeline(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	posts, err := fetchFollowingPosts(me.ID, nil)
+	if err != nil {
+		return err
+	}
+	posts, err = withViewer(posts, getCSRFToken(r), me)
+	if err != nil {
+		return err
+	}
+
+	return templates.Execute(w, "following", struct {
+		Posts PostList
+		Me    User
+	}{newPostList(posts, "/following/posts"), me})
+}
+
+// フォロー中タイムラインの「もっと見る」
+func getFollowingTimelinePosts(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		return forbiddenError("ログインが必要です")
+	}
+
+	return renderMorePosts(w, r, "/following/posts", func(cursor *Cursor) ([]Post, error) {
+		return fetchFollowingPosts(me.ID, cursor)
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/catatsuy/private-isu/webapp/golang/imagestore"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// 利用者に見せるメッセージとステータスコードを持つエラー
+// それ以外のエラーはすべて500として扱い、中身は見せない
+// sql.ErrNoRowsも500になるので、存在しないことを表すときは呼び出し側でnotFoundErrorにする
+type appError struct {
+	status  int
+	message string
+	err     error
+}
+
+func (e *appError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("%d %s: %v", e.status, e.message, e.err)
+	}
+	return fmt.Sprintf("%d %s", e.status, e.message)
+}
+
+func (e *appError) Unwrap() error {
+	return e.err
+}
+
+func notFoundError(message string) error {
+	return &appError{status: http.StatusNotFound, message: message}
+}
+
+func forbiddenError(message string) error {
+	return &appError{status: http.StatusForbidden, message: message}
+}
+
+func badRequestError(message string, err error) error {
+	return &appError{status: http.StatusBadRequest, message: message, err: err}
+}
+
+// 入力の検証エラー。CSRFトークンの不一致もこれで返す
+func validationError(message string) error {
+	return &appError{status: http.StatusUnprocessableEntity, message: message}
+}
+
+// エラーを返すハンドラー
+type appHandler func(w http.ResponseWriter, r *http.Request) error
+
+func handle(h appHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		err := h(ww, r)
+		if err == nil {
+			return
+		}
+
+		status, message := errorStatus(err)
+		logRequestError(r, status, err)
+
+		// 途中まで書き出していたら、ステータスはもう変えられない
+		if ww.Status() != 0 || ww.BytesWritten() > 0 {
+			return
+		}
+		renderError(ww, r, status, message)
+	}
+}
+
+func errorStatus(err error) (int, string) {
+	var ae *appError
+	switch {
+	case errors.As(err, &ae):
+		return ae.status, ae.message
+	case errors.Is(err, imagestore.ErrNotFound):
+		return http.StatusNotFound, "ページが見つかりません"
+	}
+	return http.StatusInternalServerError, "サーバーでエラーが発生しました"
+}
+
+func logRequestError(r *http.Request, status int, err error) {
+	route := "unknown"
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+		route = rctx.RoutePattern()
+	}
+	uid := getSession(r).Values["user_id"]
+	if uid == nil {
+		uid = 0
+	}
+
+	log.Printf("%d %s %s (route=%s user_id=%v remote=%s): %v",
+		status, r.Method, r.URL.RequestURI(), route, uid, r.RemoteAddr, err)
+}
+
+func renderError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	// 500のときはDBが落ちている可能性があるのでセッションのユーザーは引かない
+	me := User{}
+	if status < http.StatusInternalServerError {
+		me = getSessionUser(r)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err := templates.Execute(w, "error", struct {
+		Status     int
+		StatusText string
+		Message    string
+		Me         User
+	}{status, http.StatusText(status), message, me})
+	if err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/catatsuy/private-isu/webapp/golang/imagestore"
+	"golang.org/x/sync/singleflight"
+)
+
+// kindは mysql (デフォルト), local, s3 のいずれか
+func newImageStore(cfg *Config, kind string) (imagestore.Store, error) {
+	switch kind {
+	case "", "mysql":
+		return imagestore.NewMySQLStore(db), nil
+	case "local":
+		return imagestore.NewFSStore(cfg.ImageDir)
+	case "s3":
+		return imagestore.NewS3Store(cfg.S3)
+	}
+	return nil, fmt.Errorf("unknown image store %q", kind)
+}
+
+// ./app migrate-images -from mysql -to local
+func migrateImages(cfg *Config, args []string) error {
+	flags := flag.NewFlagSet("migrate-images", flag.ContinueOnError)
+	fromKind := flags.String("from", "mysql", "source image store (mysql, local, s3)")
+	toKind := flags.String("to", "", "destination image store (mysql, local, s3)")
+	deleteSource := flags.Bool("delete-source", false, "delete images from the source store after copying")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *toKind == "" || *toKind == *fromKind {
+		return fmt.Errorf("-to must be set to a store other than %q", *fromKind)
+	}
+
+	from, err := newImageStore(cfg, *fromKind)
+	if err != nil {
+		return err
+	}
+	to, err := newImageStore(cfg, *toKind)
+	if err != nil {
+		return err
+	}
+
+	result, err := imagestore.Migrate(context.Background(), db, from, to, *deleteSource)
+	log.Printf("migrated %d images from %s to %s (%d skipped)", result.Copied, *fromKind, *toKind, result.Skipped)
+	return err
+}
+
+// 非表示にした投稿の画像は、ブラウザが持っている分もこの時間が過ぎれば見えなくなる
+// 過ぎたあとはIf-None-Matchで確かめに来るので、表示中なら304だけを返す
+const imageCacheControl = "private, max-age=60"
+
+func imageETag(key imagestore.Key) string {
+	return `"` + strconv.Itoa(key.PostID) + "-" + strconv.Itoa(key.Width) + "-" + key.Ext() + `"`
+}
+
+// If-None-Matchはカンマ区切りで複数書けて、弱いETag (W/) も同じものとみなす
+func etagMatch(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// 同じ縮小版への最初のリクエストが重なっても、デコードと縮小は1回だけにする
+var imageVariantGroup singleflight.Group
+
+// 縮小版がまだなければオリジナルから作って保存する
+// 待っている他のリクエストを巻き込まないよう、呼び出し元のキャンセルは引き継がない
+func makeImageVariant(key imagestore.Key) ([]byte, error) {
+	v, err, _ := imageVariantGroup.Do(key.Path(), func() (interface{}, error) {
+		ctx := context.Background()
+		orig, err := imageStore.Get(ctx, imagestore.Key{PostID: key.PostID, Mime: key.Mime})
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := imagestore.Resize(orig, key.Mime, key.Width)
+		if err != nil {
+			return nil, err
+		}
+
+		err = imageStore.Put(ctx, key, data)
+		if err != nil {
+			log.Print(err)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+// 投稿の画像と縮小版を公開URLから外す。hideがfalseなら戻す
+func setPostImagesHidden(ctx context.Context, postID int, mime string, hide bool) error {
+	hider, ok := imageStore.(imagestore.Hider)
+	if !ok {
+		return nil
+	}
+
+	keys := []imagestore.Key{{PostID: postID, Mime: mime}}
+	for _, width := range imagestore.VariantWidths {
+		keys = append(keys, imagestore.Key{PostID: postID, Mime: mime, Width: width})
+	}
+	for _, key := range keys {
+		var err error
+		if hide {
+			err = hider.Hide(ctx, key)
+		} else {
+			err = hider.Unhide(ctx, key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 一時的なエラーなら少し待ってやり直す
+const imageMoveRetries = 3
+
+// モデレーションをコミットしたあとに呼ぶ
+// やり直しても移せなかった分は、次に起動したときにsyncHiddenPostImagesが直す
+func movePostImages(postID int, mime string, hide bool) error {
+	var err error
+	for i := 0; i < imageMoveRetries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * 200 * time.Millisecond)
+		}
+		err = setPostImagesHidden(context.Background(), postID, mime, hide)
+		if err == nil {
+			return nil
+		}
+		log.Print(err)
+	}
+	return err
+}
+
+// 非表示の投稿の画像を公開URLから外し、復元した投稿の画像を戻す
+// HideとUnhideは移し終えたものには何もしないので、毎回すべて流してよい
+func syncHiddenPostImages() error {
+	if _, ok := imageStore.(imagestore.Hider); !ok {
+		return nil
+	}
+
+	hidden := []Post{}
+	err := db.Select(&hidden, "SELECT `id`, `mime` FROM `posts` WHERE `hidden_at` IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	restored := []Post{}
+	err = db.Select(&restored, "SELECT DISTINCT p.id, p.mime FROM posts p JOIN moderation_logs l ON l.content_id = p.id AND l.action = ? WHERE p.hidden_at IS NULL", moderationRestorePost)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	for _, p := range hidden {
+		err := setPostImagesHidden(ctx, p.ID, p.Mime, true)
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range restored {
+		err := setPostImagesHidden(ctx, p.ID, p.Mime, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package imagestore
+
+import (
+	"bytes"
+	"errors"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("imagestore: unsupported image format")
+	ErrCorrupted         = errors.New("imagestore: image could not be decoded")
+)
+
+// 先頭のマジックバイトから形式を判定し、実際にデコードできるかまで確かめる
+// 大きすぎる画像はデコードせずにErrTooLargeを返す
+func DetectMime(data []byte) (string, error) {
+	mime := http.DetectContentType(data)
+	if Ext(mime) == "" {
+		return "", ErrUnsupportedFormat
+	}
+
+	err := checkSize(data)
+	if err != nil {
+		return "", err
+	}
+
+	switch mime {
+	case "image/jpeg":
+		_, err = jpeg.Decode(bytes.NewReader(data))
+	case "image/png":
+		_, err = png.Decode(bytes.NewReader(data))
+	case "image/gif":
+		_, err = gif.DecodeAll(bytes.NewReader(data))
+	}
+	if err != nil {
+		return "", ErrCorrupted
+	}
+
+	return mime, nil
+}
@@ -0,0 +1,75 @@
+package imagestore
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ローカルのディレクトリに Key.Path() で保存する
+// 非表示の投稿の画像を返さないようにgetImage経由で配信するので、公開ディレクトリの外を指定する
+type FSStore struct {
+	dir string
+}
+
+func NewFSStore(dir string) (*FSStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &FSStore{dir: dir}, nil
+}
+
+func (s *FSStore) path(key Key) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key.Path()))
+}
+
+// 書き込み途中のファイルが配信されないようにrenameで置き換える
+func (s *FSStore) Put(ctx context.Context, key Key, data []byte) error {
+	dst := s.path(key)
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(f.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), dst)
+}
+
+func (s *FSStore) Get(ctx context.Context, key Key) ([]byte, error) {
+	data, err := os.ReadFile(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s *FSStore) Delete(ctx context.Context, key Key) error {
+	err := os.Remove(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *FSStore) URL(key Key) string {
+	return LocalURL(key)
+}
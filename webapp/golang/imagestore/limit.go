@@ -0,0 +1,114 @@
+package imagestore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+)
+
+// デコードすると展開後の大きさ分のメモリを確保するので、ヘッダーを見て先に断る
+const (
+	// 1枚あたりの画素数。RGBAで展開すると4倍のバイト数になる
+	MaxPixels = 25_000_000
+	// GIFのフレーム数と、全フレームの画素数の合計
+	MaxGIFFrames = 500
+	MaxGIFPixels = 100_000_000
+)
+
+var ErrTooLarge = errors.New("imagestore: image is too large")
+
+// デコードする前にヘッダーから大きさを確かめる
+func checkSize(data []byte) error {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return ErrCorrupted
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return ErrCorrupted
+	}
+	if cfg.Width > MaxPixels/cfg.Height {
+		return ErrTooLarge
+	}
+	if format != "gif" {
+		return nil
+	}
+
+	frames, pixels, err := gifFrameSizes(data)
+	if err != nil {
+		return err
+	}
+	if frames > MaxGIFFrames || pixels > MaxGIFPixels {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+// GIFのブロックをたどって、フレーム数と各フレームの画素数の合計を数える
+// cf: https://www.w3.org/Graphics/GIF/spec-gif89a.txt
+func gifFrameSizes(data []byte) (int, int, error) {
+	// ヘッダー(6)と論理画面記述子(7)
+	if len(data) < 13 {
+		return 0, 0, ErrCorrupted
+	}
+	pos := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&0x07 + 1)
+	}
+
+	frames, pixels := 0, 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // 拡張ブロック
+			if pos+2 > len(data) {
+				return 0, 0, ErrCorrupted
+			}
+			next, ok := skipSubBlocks(data, pos+2)
+			if !ok {
+				return 0, 0, ErrCorrupted
+			}
+			pos = next
+		case 0x2c: // イメージ記述子
+			if pos+10 > len(data) {
+				return 0, 0, ErrCorrupted
+			}
+			w := int(binary.LittleEndian.Uint16(data[pos+5:]))
+			h := int(binary.LittleEndian.Uint16(data[pos+7:]))
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			// LZWの最小コードサイズに続いて画像データ
+			next, ok := skipSubBlocks(data, pos+1)
+			if !ok {
+				return 0, 0, ErrCorrupted
+			}
+			pos = next
+
+			frames++
+			pixels += w * h
+			if frames > MaxGIFFrames || pixels > MaxGIFPixels {
+				return frames, pixels, nil
+			}
+		case 0x3b: // 終端
+			return frames, pixels, nil
+		default:
+			return 0, 0, ErrCorrupted
+		}
+	}
+	return 0, 0, ErrCorrupted
+}
+
+// サイズ1バイトとデータが続き、サイズ0で終わる
+func skipSubBlocks(data []byte, pos int) (int, bool) {
+	for pos < len(data) {
+		n := int(data[pos])
+		pos++
+		if n == 0 {
+			return pos, true
+		}
+		pos += n
+	}
+	return 0, false
+}
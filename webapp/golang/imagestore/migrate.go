@@ -0,0 +1,56 @@
+package imagestore
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type MigrateResult struct {
+	Copied  int
+	Skipped int
+}
+
+// postsに登録されている全画像をfromからtoへコピーする
+// fromに存在しない画像は飛ばす。deleteSourceならコピーできたものをfromから消す
+// 縮小版は必要になった時点で作り直されるので移行しない
+func Migrate(ctx context.Context, db *sqlx.DB, from, to Store, deleteSource bool) (MigrateResult, error) {
+	result := MigrateResult{}
+
+	images := []struct {
+		ID   int    `db:"id"`
+		Mime string `db:"mime"`
+	}{}
+	err := db.SelectContext(ctx, &images, "SELECT `id`, `mime` FROM `posts` ORDER BY `id`")
+	if err != nil {
+		return result, err
+	}
+
+	for _, img := range images {
+		key := Key{PostID: img.ID, Mime: img.Mime}
+		data, err := from.Get(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			result.Skipped++
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+
+		err = to.Put(ctx, key, data)
+		if err != nil {
+			return result, err
+		}
+
+		if deleteSource {
+			err = from.Delete(ctx, key)
+			if err != nil {
+				return result, err
+			}
+		}
+		result.Copied++
+	}
+
+	return result, nil
+}
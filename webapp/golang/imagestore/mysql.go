@@ -0,0 +1,62 @@
+package imagestore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// オリジナルはposts.imgdataに、縮小版はpost_image_variantsに持つ
+type MySQLStore struct {
+	db *sqlx.DB
+}
+
+func NewMySQLStore(db *sqlx.DB) *MySQLStore {
+	return &MySQLStore{db: db}
+}
+
+func (s *MySQLStore) Put(ctx context.Context, key Key, data []byte) error {
+	if key.Width != 0 {
+		_, err := s.db.ExecContext(ctx,
+			"INSERT INTO `post_image_variants` (`post_id`, `width`, `imgdata`) VALUES (?,?,?) ON DUPLICATE KEY UPDATE `imgdata` = VALUES(`imgdata`)",
+			key.PostID, key.Width, data)
+		return err
+	}
+
+	_, err := s.db.ExecContext(ctx, "UPDATE `posts` SET `imgdata` = ? WHERE `id` = ?", data, key.PostID)
+	return err
+}
+
+func (s *MySQLStore) Get(ctx context.Context, key Key) ([]byte, error) {
+	var data []byte
+	var err error
+	if key.Width != 0 {
+		err = s.db.GetContext(ctx, &data, "SELECT `imgdata` FROM `post_image_variants` WHERE `post_id` = ? AND `width` = ?", key.PostID, key.Width)
+	} else {
+		err = s.db.GetContext(ctx, &data, "SELECT `imgdata` FROM `posts` WHERE `id` = ?", key.PostID)
+	}
+	if errors.Is(err, sql.ErrNoRows) || err == nil && len(data) == 0 {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// imgdataはNOT NULLなので空にする
+func (s *MySQLStore) Delete(ctx context.Context, key Key) error {
+	if key.Width != 0 {
+		_, err := s.db.ExecContext(ctx, "DELETE FROM `post_image_variants` WHERE `post_id` = ? AND `width` = ?", key.PostID, key.Width)
+		return err
+	}
+
+	_, err := s.db.ExecContext(ctx, "UPDATE `posts` SET `imgdata` = '' WHERE `id` = ?", key.PostID)
+	return err
+}
+
+func (s *MySQLStore) URL(key Key) string {
+	return LocalURL(key)
+}
@@ -0,0 +1,108 @@
+package imagestore
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+)
+
+// 縮小版を用意する幅。post.htmlのsrcsetに並ぶ
+var VariantWidths = []int{320, 540, 1080}
+
+func IsVariantWidth(width int) bool {
+	for _, w := range VariantWidths {
+		if w == width {
+			return true
+		}
+	}
+	return false
+}
+
+// 画像をwidthまで縮小してmimeと同じ形式でエンコードする
+// 元の幅がwidth以下なら拡大せずそのまま返す
+func Resize(data []byte, mime string, width int) ([]byte, error) {
+	err := checkSize(data)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mime {
+	case "image/jpeg":
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if img.Bounds().Dx() <= width {
+			return data, nil
+		}
+		var buf bytes.Buffer
+		err = jpeg.Encode(&buf, scale(img, width), &jpeg.Options{Quality: 85})
+		return buf.Bytes(), err
+	case "image/png":
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if img.Bounds().Dx() <= width {
+			return data, nil
+		}
+		var buf bytes.Buffer
+		err = png.Encode(&buf, scale(img, width))
+		return buf.Bytes(), err
+	case "image/gif":
+		return resizeGIF(data, width)
+	}
+	return nil, fmt.Errorf("imagestore: unsupported mime %q", mime)
+}
+
+func scaledSize(b image.Rectangle, width int) image.Rectangle {
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+	return image.Rect(0, 0, width, height)
+}
+
+func scale(img image.Image, width int) image.Image {
+	dst := image.NewRGBA(scaledSize(img.Bounds(), width))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return dst
+}
+
+// アニメーションを保つため全フレームを縮小する
+// パレットと透過色を崩さないようにNearestNeighborを使う
+func resizeGIF(data []byte, width int) ([]byte, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if g.Config.Width <= width {
+		return data, nil
+	}
+
+	sc := func(v int) int { return v * width / g.Config.Width }
+
+	for i, frame := range g.Image {
+		b := frame.Bounds()
+		r := image.Rect(sc(b.Min.X), sc(b.Min.Y), sc(b.Max.X), sc(b.Max.Y))
+		if r.Dx() < 1 {
+			r.Max.X = r.Min.X + 1
+		}
+		if r.Dy() < 1 {
+			r.Max.Y = r.Min.Y + 1
+		}
+		dst := image.NewPaletted(r, frame.Palette)
+		draw.NearestNeighbor.Scale(dst, r, frame, b, draw.Src, nil)
+		g.Image[i] = dst
+	}
+	g.Config.Width, g.Config.Height = width, scaledSize(image.Rect(0, 0, g.Config.Width, g.Config.Height), width).Dy()
+
+	var buf bytes.Buffer
+	err = gif.EncodeAll(&buf, g)
+	return buf.Bytes(), err
+}
@@ -0,0 +1,249 @@
+package imagestore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+type S3Config struct {
+	// http://localhost:9000 のようなエンドポイント。MinIOなどS3互換のものでもよい
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// 設定するとHTMLにはこのURLを埋め込み、クライアントはバケットから直接取得する
+	// 公開するのはimage/以下だけにすること。非表示にした投稿の画像はhidden/以下に移す
+	PublicURL string
+}
+
+// パス形式 ({endpoint}/{bucket}/{key}) でアクセスするS3互換ストレージ
+// 必要なのはPUT/GET/DELETEだけなのでSDKは使わずSigV4で署名する
+type S3Store struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("imagestore: invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("imagestore: S3 bucket is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+
+	return &S3Store{
+		cfg:      cfg,
+		endpoint: u,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (s *S3Store) objectKey(key Key) string {
+	return "image/" + key.Path()
+}
+
+func (s *S3Store) hiddenKey(key Key) string {
+	return "hidden/image/" + key.Path()
+}
+
+func (s *S3Store) Put(ctx context.Context, key Key, data []byte) error {
+	return s.putObject(ctx, s.objectKey(key), data, key.Mime)
+}
+
+func (s *S3Store) putObject(ctx context.Context, objectKey string, data []byte, contentType string) error {
+	res, err := s.do(ctx, http.MethodPut, objectKey, data, contentType)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return s.statusError(res)
+	}
+	return nil
+}
+
+func (s *S3Store) Get(ctx context.Context, key Key) ([]byte, error) {
+	return s.getObject(ctx, s.objectKey(key))
+}
+
+func (s *S3Store) getObject(ctx context.Context, objectKey string) ([]byte, error) {
+	res, err := s.do(ctx, http.MethodGet, objectKey, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, s.statusError(res)
+	}
+	return io.ReadAll(res.Body)
+}
+
+func (s *S3Store) Delete(ctx context.Context, key Key) error {
+	return s.deleteObject(ctx, s.objectKey(key))
+}
+
+func (s *S3Store) deleteObject(ctx context.Context, objectKey string) error {
+	res, err := s.do(ctx, http.MethodDelete, objectKey, nil, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return s.statusError(res)
+	}
+	return nil
+}
+
+// PublicURLを使わないときはgetImageが非表示の投稿を返さないので移さない
+func (s *S3Store) Hide(ctx context.Context, key Key) error {
+	if s.cfg.PublicURL == "" {
+		return nil
+	}
+	return s.move(ctx, s.objectKey(key), s.hiddenKey(key), key.Mime)
+}
+
+func (s *S3Store) Unhide(ctx context.Context, key Key) error {
+	if s.cfg.PublicURL == "" {
+		return nil
+	}
+	return s.move(ctx, s.hiddenKey(key), s.objectKey(key), key.Mime)
+}
+
+// コピーしてから消す。移し元がなければ移し終えているので何もしない
+func (s *S3Store) move(ctx context.Context, from, to, contentType string) error {
+	data, err := s.getObject(ctx, from)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = s.putObject(ctx, to, data, contentType)
+	if err != nil {
+		return err
+	}
+	return s.deleteObject(ctx, from)
+}
+
+func (s *S3Store) URL(key Key) string {
+	if s.cfg.PublicURL == "" {
+		return LocalURL(key)
+	}
+	return strings.TrimSuffix(s.cfg.PublicURL, "/") + "/" + s.objectKey(key)
+}
+
+func (s *S3Store) statusError(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("imagestore: %s %s: %s: %s", res.Request.Method, res.Request.URL, res.Status, body)
+}
+
+func (s *S3Store) do(ctx context.Context, method, key string, body []byte, contentType string) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket + "/" + key
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, body, time.Now().UTC())
+
+	return s.client.Do(req)
+}
+
+// cf: https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+func (s *S3Store) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		headers["content-type"] = ct
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
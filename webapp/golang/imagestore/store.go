@@ -0,0 +1,66 @@
+package imagestore
+
+import (
+	"context"
+	"errors"
+	"strconv"
+)
+
+var ErrNotFound = errors.New("imagestore: image not found")
+
+// 画像は投稿ID・mime・幅で一意に決まる
+type Key struct {
+	PostID int
+	Mime   string
+	// 0ならアップロードされたオリジナル、それ以外はこの幅に縮小したもの
+	Width int
+}
+
+func (k Key) Ext() string {
+	return Ext(k.Mime)
+}
+
+// {id}.{ext} または w{width}/{id}.{ext}
+func (k Key) Path() string {
+	name := strconv.Itoa(k.PostID)
+	if ext := k.Ext(); ext != "" {
+		name += "." + ext
+	}
+	if k.Width == 0 {
+		return name
+	}
+	return "w" + strconv.Itoa(k.Width) + "/" + name
+}
+
+// 投稿画像の保存先
+type Store interface {
+	Put(ctx context.Context, key Key, data []byte) error
+	Get(ctx context.Context, key Key) ([]byte, error)
+	Delete(ctx context.Context, key Key) error
+	// HTMLに埋め込む画像のURL
+	URL(key Key) string
+}
+
+// 公開URLから直接配信するStoreは、非表示にした投稿の画像をそのURLで取得できない場所へ移す
+// 移したあとはGetで取得できなくなる。どちらも移し終えたものに対して呼んでもよい
+type Hider interface {
+	Hide(ctx context.Context, key Key) error
+	Unhide(ctx context.Context, key Key) error
+}
+
+func Ext(mime string) string {
+	switch mime {
+	case "image/jpeg":
+		return "jpg"
+	case "image/png":
+		return "png"
+	case "image/gif":
+		return "gif"
+	}
+	return ""
+}
+
+// /image/ 以下はgetImageがStore経由で返す
+func LocalURL(key Key) string {
+	return "/image/" + key.Path()
+}
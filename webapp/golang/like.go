@@ -0,0 +1,60 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func postLike(w http.ResponseWriter, r *http.Request) error {
+	return changeLike(w, r, true)
+}
+
+func postUnlike(w http.ResponseWriter, r *http.Request) error {
+	return changeLike(w, r, false)
+}
+
+func changeLike(w http.ResponseWriter, r *http.Request, like bool) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		return validationError("CSRFトークンが一致しません")
+	}
+
+	postID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return notFoundError("投稿が見つかりません")
+	}
+
+	// 非表示にした投稿にはいいねさせない
+	exists := 0
+	err = db.Get(&exists, "SELECT 1 FROM `posts` WHERE `id` = ? AND `hidden_at` IS NULL", postID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFoundError("投稿が見つかりません")
+	}
+	if err != nil {
+		return err
+	}
+
+	if like {
+		_, err = db.Exec("INSERT IGNORE INTO `likes` (`post_id`, `user_id`) VALUES (?,?)", postID, me.ID)
+	} else {
+		_, err = db.Exec("DELETE FROM `likes` WHERE `post_id` = ? AND `user_id` = ?", postID, me.ID)
+	}
+	if err != nil {
+		return err
+	}
+
+	invalidateLikeCache(postID)
+
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d", postID), http.StatusFound)
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"html/template"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// text[i]の直前が文字・数字・_ならtrue。#tag や @name を単語の途中から拾わないために使う
+func inWord(text string, i int) bool {
+	if i == 0 {
+		return false
+	}
+	prev, _ := utf8.DecodeLastRuneInString(text[:i])
+	return prev == '_' || unicode.IsLetter(prev) || unicode.IsNumber(prev)
+}
+
+// 本文中でリンクにする範囲
+type textLink struct {
+	start, end int
+	href       string
+	class      string
+}
+
+// textをエスケープし、linksの範囲だけリンクにする。範囲は重ならないこと
+func renderLinks(text string, links []textLink) template.HTML {
+	sort.Slice(links, func(i, j int) bool { return links[i].start < links[j].start })
+
+	var b strings.Builder
+	last := 0
+	for _, l := range links {
+		b.WriteString(template.HTMLEscapeString(text[last:l.start]))
+		b.WriteString(`<a href="`)
+		b.WriteString(template.HTMLEscapeString(l.href))
+		b.WriteString(`" class="`)
+		b.WriteString(l.class)
+		b.WriteString(`">`)
+		b.WriteString(template.HTMLEscapeString(text[l.start:l.end]))
+		b.WriteString(`</a>`)
+		last = l.end
+	}
+	b.WriteString(template.HTMLEscapeString(text[last:]))
+	return template.HTML(b.String())
+}
+
+// コメントはタグとメンションの両方をリンクにする
+// どちらも直前が単語の途中なら拾わないので、範囲が重なることはない
+func linkComment(text string) template.HTML {
+	return renderLinks(text, append(tagLinks(text), mentionLinks(text)...))
+}
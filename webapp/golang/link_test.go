@@ -0,0 +1,123 @@
+package main
+
+import (
+	"html/template"
+	"reflect"
+	"testing"
+)
+
+func TestLinkComment(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want template.HTML
+	}{
+		{
+			"plain text",
+			"こんにちは",
+			"こんにちは",
+		},
+		{
+			"script tag",
+			`<script>alert(1)</script>`,
+			`&lt;script&gt;alert(1)&lt;/script&gt;`,
+		},
+		{
+			"mention inside a script tag",
+			`<script>alert("@alice")</script>`,
+			`&lt;script&gt;alert(&#34;<a href="/@alice" class="isu-mention">@alice</a>&#34;)&lt;/script&gt;`,
+		},
+		{
+			"ampersand",
+			"a & b",
+			"a &amp; b",
+		},
+		{
+			"quotes",
+			`"@alice" 'bob'`,
+			`&#34;<a href="/@alice" class="isu-mention">@alice</a>&#34; &#39;bob&#39;`,
+		},
+		{
+			"attribute breakout after a tag",
+			`#tag"><img src=x onerror=alert(1)>`,
+			`<a href="/tags/tag" class="isu-tag">#tag</a>&#34;&gt;&lt;img src=x onerror=alert(1)&gt;`,
+		},
+		{
+			"mention after an entity",
+			"&amp;@alice",
+			`&amp;amp;<a href="/@alice" class="isu-mention">@alice</a>`,
+		},
+		{
+			"numeric entities are not tags",
+			"&#64;bob &#35;tag &#tag",
+			"&amp;#64;bob &amp;#35;tag &amp;#tag",
+		},
+		{
+			"tag right after a mention",
+			"@alice#tag",
+			`<a href="/@alice" class="isu-mention">@alice</a>#tag`,
+		},
+		{
+			"mention right after a tag",
+			"#tag@alice",
+			`<a href="/tags/tag" class="isu-tag">#tag</a>@alice`,
+		},
+		{
+			"repeated and mixed markers",
+			"@@alice ##tag #@alice @#tag",
+			`@<a href="/@alice" class="isu-mention">@alice</a> #<a href="/tags/tag" class="isu-tag">#tag</a> #<a href="/@alice" class="isu-mention">@alice</a> @<a href="/tags/tag" class="isu-tag">#tag</a>`,
+		},
+		{
+			"email address",
+			"mail@example.com",
+			"mail@example.com",
+		},
+		{
+			"name too short",
+			"@ab",
+			"@ab",
+		},
+		{
+			"mention followed by markup",
+			"@alice_<b>",
+			`<a href="/@alice_" class="isu-mention">@alice_</a>&lt;b&gt;`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := linkComment(tt.text); got != tt.want {
+				t.Errorf("linkComment(%q)\n got %s\nwant %s", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+// hrefも本文と同じくエスケープすること
+func TestRenderLinks_escapesHref(t *testing.T) {
+	text := "see here"
+	links := []textLink{{start: 4, end: 8, href: `/x?a=1&b="2"`, class: "isu-tag"}}
+
+	want := template.HTML(`see <a href="/x?a=1&amp;b=&#34;2&#34;" class="isu-tag">here</a>`)
+	if got := renderLinks(text, links); got != want {
+		t.Errorf("renderLinks(%q)\n got %s\nwant %s", text, got, want)
+	}
+}
+
+func TestExtractMentions(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"@alice と @bob", []string{"alice", "bob"}},
+		{"@alice @alice @Alice", []string{"alice", "Alice"}},
+		{"mail@example.com", []string{}},
+		{"日本語@alice", []string{}},
+		{"(@alice)", []string{"alice"}},
+		{"@alice-bob", []string{"alice"}},
+	}
+	for _, tt := range tests {
+		if got := extractMentions(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("extractMentions(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import "regexp"
+
+var mentionRegexp = regexp.MustCompile(`@` + accountNamePattern)
+
+// 本文中の @account_name の位置。メールアドレスのように直前が単語の途中なら拾わない
+func findMentions(text string) [][]int {
+	var locs [][]int
+	for _, loc := range mentionRegexp.FindAllStringIndex(text, -1) {
+		if inWord(text, loc[0]) {
+			continue
+		}
+		locs = append(locs, loc)
+	}
+	return locs
+}
+
+// 重複を除いたメンション先のアカウント名。存在するかどうかは見ない
+func extractMentions(text string) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, loc := range findMentions(text) {
+		name := text[loc[0]+1 : loc[1]]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+func mentionLinks(text string) []textLink {
+	var links []textLink
+	for _, loc := range findMentions(text) {
+		links = append(links, textLink{start: loc[0], end: loc[1], href: accountURL(text[loc[0]+1 : loc[1]]), class: "isu-mention"})
+	}
+	return links
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/catatsuy/private-isu/webapp/golang/cache"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "isuconp_http_requests_total",
+		Help: "Number of HTTP requests by route pattern and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "isuconp_http_request_duration_seconds",
+		Help:    "HTTP request latency by route pattern.",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"method", "route"})
+)
+
+func registerMetrics() {
+	prometheus.MustRegister(httpRequestsTotal, httpRequestDuration, rateLimitedTotal)
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db.DB, "isuconp"))
+
+	registerCacheMetrics("posts", postsCache.Stats)
+	registerCacheMetrics("comments", commentsCache.Stats)
+	registerCacheMetrics("comment_count", commentCountCache.Stats)
+	registerCacheMetrics("like_count", likeCountCache.Stats)
+	registerCacheMetrics("user", userCache.Stats)
+	registerCacheMetrics("user_stats", userStatsCache.Stats)
+	registerCacheMetrics("unread_notification_count", unreadNotificationCountCache.Stats)
+}
+
+// cacheパッケージは自前で数えているだけなので、収集時に読みに行く
+func registerCacheMetrics(name string, stats func() cache.Stats) {
+	labels := prometheus.Labels{"cache": name}
+	prometheus.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "isuconp_cache_local_hits_total",
+			Help:        "Number of cache hits served from the in-process LRU.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(stats().LocalHits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "isuconp_cache_memcached_hits_total",
+			Help:        "Number of cache hits served from memcached.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(stats().RemoteHits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "isuconp_cache_misses_total",
+			Help:        "Number of cache misses.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(stats().Misses) }),
+	)
+}
+
+// ラベルには生のパスではなく /posts/{id} のようなルートのパターンを使う
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		route := chi.RouteContext(r.Context()).RoutePattern()
+		if route == "" {
+			route = "unknown"
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		httpRequestsTotal.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		httpRequestDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const notificationListLimit = 100
+
+// 通知の種類
+const (
+	notificationComment = "comment"
+	notificationMention = "mention"
+)
+
+type Notification struct {
+	ID               int          `db:"id"`
+	Kind             string       `db:"kind"`
+	PostID           int          `db:"post_id"`
+	CommentID        int          `db:"comment_id"`
+	ReadAt           sql.NullTime `db:"read_at"`
+	CreatedAt        time.Time    `db:"created_at"`
+	ActorAccountName string       `db:"actor_account_name"`
+	Comment          string       `db:"comment"`
+}
+
+func (n Notification) Message() string {
+	if n.Kind == notificationMention {
+		return "さんがコメントであなたについて言及しました"
+	}
+	return "さんがあなたの投稿にコメントしました"
+}
+
+func unreadNotificationCountCacheKey(userID int) string {
+	return "unread_notifications_" + strconv.Itoa(userID)
+}
+
+// 一覧に出さない通知は既読にならないので数えない
+func fetchUnreadNotificationCount(userID int) (int, error) {
+	return unreadNotificationCountCache.Fetch(unreadNotificationCountCacheKey(userID), func() (int, error) {
+		count := 0
+		query := "SELECT COUNT(*) AS `count` FROM `notifications` AS `n` " +
+			"JOIN `users` AS `u` ON `u`.`id` = `n`.`actor_id` " +
+			"JOIN `comments` AS `c` ON `c`.`id` = `n`.`comment_id` " +
+			"WHERE `n`.`user_id` = ? AND `n`.`read_at` IS NULL AND `u`.`del_flg` = 0 AND `c`.`hidden_at` IS NULL"
+		err := db.Get(&count, query, userID)
+		return count, err
+	})
+}
+
+func invalidateUnreadNotificationCountCache(userIDs ...int) {
+	keys := make([]string, 0, len(userIDs))
+	for _, id := range userIDs {
+		keys = append(keys, unreadNotificationCountCacheKey(id))
+	}
+	err := unreadNotificationCountCache.Delete(keys...)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// コメントされた投稿の持ち主と、コメント中でメンションされたユーザーに通知する
+// 両方に当たる場合はメンションとして1件だけ。自分自身とBANされたユーザーには通知しない
+func notifyComment(actorID, postID, postUserID, commentID int, comment string) error {
+	kinds := map[int]string{}
+	if postUserID != actorID {
+		postUser, err := fetchUser(postUserID)
+		if err != nil {
+			return err
+		}
+		if postUser.DelFlg == 0 {
+			kinds[postUserID] = notificationComment
+		}
+	}
+
+	if names := extractMentions(comment); len(names) > 0 {
+		query, args, err := sqlx.In("SELECT `id` FROM `users` WHERE `account_name` IN (?) AND `del_flg` = 0", names)
+		if err != nil {
+			return err
+		}
+		userIDs := []int{}
+		err = db.Select(&userIDs, query, args...)
+		if err != nil {
+			return err
+		}
+		for _, id := range userIDs {
+			if id != actorID {
+				kinds[id] = notificationMention
+			}
+		}
+	}
+
+	if len(kinds) == 0 {
+		return nil
+	}
+
+	values := make([]string, 0, len(kinds))
+	args := make([]interface{}, 0, len(kinds)*5)
+	userIDs := make([]int, 0, len(kinds))
+	for userID, kind := range kinds {
+		values = append(values, "(?,?,?,?,?)")
+		args = append(args, userID, actorID, kind, postID, commentID)
+		userIDs = append(userIDs, userID)
+	}
+	query := "INSERT INTO `notifications` (`user_id`, `actor_id`, `kind`, `post_id`, `comment_id`) VALUES " + strings.Join(values, ",")
+	_, err := db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	invalidateUnreadNotificationCountCache(userIDs...)
+	return nil
+}
+
+// 新しい順。非表示にしたコメントとBANされたユーザーからの通知は出さない
+func fetchNotifications(userID int) ([]Notification, error) {
+	notifications := []Notification{}
+	query := "SELECT `n`.`id`, `n`.`kind`, `n`.`post_id`, `n`.`comment_id`, `n`.`read_at`, `n`.`created_at`, " +
+		"`u`.`account_name` AS `actor_account_name`, `c`.`comment` " +
+		"FROM `notifications` AS `n` " +
+		"JOIN `users` AS `u` ON `u`.`id` = `n`.`actor_id` " +
+		"JOIN `comments` AS `c` ON `c`.`id` = `n`.`comment_id` " +
+		"WHERE `n`.`user_id` = ? AND `u`.`del_flg` = 0 AND `c`.`hidden_at` IS NULL " +
+		"ORDER BY `n`.`created_at` DESC, `n`.`id` DESC LIMIT ?"
+	err := db.Select(&notifications, query, userID, notificationListLimit)
+	return notifications, err
+}
+
+// 一覧を表示したら既読にする。既読にする前に取得するので、今回はじめて見たものは未読として表示される
+// 既読にするのは表示したものだけ。取得したあとに届いたものや一覧に入りきらなかったものは未読のまま残す
+func getNotifications(w http.ResponseWriter, r *http.Request) error {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+
+	notifications, err := fetchNotifications(me.ID)
+	if err != nil {
+		return err
+	}
+
+	unreadIDs := []int{}
+	for _, n := range notifications {
+		if !n.ReadAt.Valid {
+			unreadIDs = append(unreadIDs, n.ID)
+		}
+	}
+	if len(unreadIDs) > 0 {
+		query, args, err := sqlx.In("UPDATE `notifications` SET `read_at` = NOW() WHERE `user_id` = ? AND `read_at` IS NULL AND `id` IN (?)", me.ID, unreadIDs)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(query, args...)
+		if err != nil {
+			return err
+		}
+		invalidateUnreadNotificationCountCache(me.ID)
+		me.UnreadNotificationCount, err = fetchUnreadNotificationCount(me.ID)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+
+	return templates.Execute(w, "notifications", struct {
+		Notifications []Notification
+		Me            User
+	}{notifications, me})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// 一覧のページ位置。created_atが同じ投稿はidで順序付けるので重複も欠落もしない
+type Cursor struct {
+	CreatedAt time.Time
+	ID        int
+}
+
+// クライアントからは中身を見せない不透明な文字列として扱う
+func (c Cursor) String() string {
+	raw := strconv.FormatInt(c.CreatedAt.Unix(), 10) + "_" + strconv.Itoa(c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseCursor(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+
+	ts, id, ok := strings.Cut(string(raw), "_")
+	if !ok {
+		return nil, errInvalidCursor
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	// idは1から振られるので、それ以外は作った覚えのないカーソル
+	pid, err := strconv.Atoi(id)
+	if err != nil || pid <= 0 {
+		return nil, errInvalidCursor
+	}
+
+	return &Cursor{CreatedAt: time.Unix(sec, 0), ID: pid}, nil
+}
+
+// ORDER BY posts.created_at DESC, posts.id DESC と組み合わせて使う
+func cursorCondition(c *Cursor) (string, []interface{}) {
+	if c == nil {
+		return "", nil
+	}
+
+	return "AND (posts.created_at < ? OR (posts.created_at = ? AND posts.id < ?))",
+		[]interface{}{c.CreatedAt, c.CreatedAt, c.ID}
+}
+
+func (p Post) Cursor() string {
+	return Cursor{CreatedAt: p.CreatedAt, ID: p.ID}.String()
+}
+
+// テンプレートに渡す1ページ分の投稿と次ページへのリンク
+type PostList struct {
+	Posts   []Post
+	NextURL string
+}
+
+// 1ページ分埋まっている場合のみbasePathに次ページのカーソルを付けたURLを返す
+// basePathには検索語などのクエリを含めてもよい
+func nextPageURL(posts []Post, basePath string) string {
+	if basePath == "" || len(posts) < postsPerPage {
+		return ""
+	}
+
+	sep := "?"
+	if strings.Contains(basePath, "?") {
+		sep = "&"
+	}
+	return basePath + sep + "cursor=" + url.QueryEscape(posts[len(posts)-1].Cursor())
+}
+
+func newPostList(posts []Post, basePath string) PostList {
+	return PostList{Posts: posts, NextURL: nextPageURL(posts, basePath)}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCursor_roundTrip(t *testing.T) {
+	c := Cursor{CreatedAt: time.Unix(1700000000, 0), ID: 42}
+
+	got, err := parseCursor(c.String())
+	if err != nil {
+		t.Fatalf("expected %q to parse but got %v", c.String(), err)
+	}
+	if !got.CreatedAt.Equal(c.CreatedAt) || got.ID != c.ID {
+		t.Errorf("expected %+v but got %+v", c, *got)
+	}
+}
+
+func TestParseCursor_invalid(t *testing.T) {
+	raw := func(s string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(s))
+	}
+
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "!!!"},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte("1700000000_12"))},
+		{"standard base64 alphabet", "+/+/"},
+		{"no separator", raw("1700000000")},
+		{"empty parts", raw("_")},
+		{"non-numeric time", raw("yesterday_1")},
+		{"non-numeric id", raw("1700000000_abc")},
+		{"fractional id", raw("1700000000_1.5")},
+		{"extra part", raw("1700000000_1_2")},
+		{"negative id", raw("1700000000_-1")},
+		{"zero id", raw("1700000000_0")},
+		{"id overflow", raw("1700000000_99999999999999999999")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCursor(tt.cursor)
+			if !errors.Is(err, errInvalidCursor) {
+				t.Errorf("expected errInvalidCursor for %q but got %+v, %v", tt.cursor, c, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/catatsuy/private-isu/webapp/golang/ratelimit"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// nilなら制限しない
+var rateLimiter *ratelimit.Limiter
+
+// 接続元のIPアドレスを入れるヘッダー。空ならRemoteAddrを使う
+// リバースプロキシが上書きするヘッダーだけを指定すること
+var realIPHeader string
+
+var rateLimitedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "isuconp_rate_limited_total",
+	Help: "Number of requests rejected by the rate limiter.",
+}, []string{"rule", "scope"})
+
+// ルートごとの制限。IPアドレスごとと、アカウントごとのバケツを両方使う
+// 回数はconfigureRateLimitsで設定から埋める
+type rateLimitRule struct {
+	// memcachedのキーとメトリクスのラベルに使う
+	name       string
+	perIP      ratelimit.Limit
+	perAccount ratelimit.Limit
+	// アカウントごとの制限に使うアカウント。空文字列なら使わない
+	account func(r *http.Request) string
+	// 制限したときにフラッシュメッセージを出して戻すページ。空なら429を返す
+	redirect string
+}
+
+var (
+	loginRateLimit = rateLimitRule{
+		name:     "login",
+		account:  formAccountName,
+		redirect: "/login",
+	}
+	registerRateLimit = rateLimitRule{
+		name:     "register",
+		redirect: "/register",
+	}
+	postRateLimit = rateLimitRule{
+		name:     "post",
+		account:  sessionAccount,
+		redirect: "/",
+	}
+	commentRateLimit = rateLimitRule{
+		name:    "comment",
+		account: sessionAccount,
+	}
+)
+
+// newRouterより前に呼ぶ
+func configureRateLimits(cfg *Config) {
+	loginRateLimit.perIP = cfg.LoginRateLimit.limit()
+	loginRateLimit.perAccount = cfg.LoginAccountRateLimit.limit()
+	registerRateLimit.perIP = cfg.RegisterRateLimit.limit()
+	postRateLimit.perIP = cfg.PostRateLimit.limit()
+	postRateLimit.perAccount = cfg.PostAccountRateLimit.limit()
+	commentRateLimit.perIP = cfg.CommentRateLimit.limit()
+	commentRateLimit.perAccount = cfg.CommentAccountRateLimit.limit()
+}
+
+// ログインを試みているアカウント名
+// account_nameの照合順序は大文字と小文字を区別しないので、同じアカウントになる名前は同じバケツにする
+func formAccountName(r *http.Request) string {
+	return strings.ToLower(strings.TrimSpace(r.FormValue("account_name")))
+}
+
+// ログイン中のユーザー。multipartの本文を読まずに済むようにセッションから引く
+func sessionAccount(r *http.Request) string {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		return ""
+	}
+	return strconv.Itoa(me.ID)
+}
+
+func clientIP(r *http.Request) string {
+	if realIPHeader != "" {
+		if v := r.Header.Get(realIPHeader); v != "" {
+			ip, _, _ := strings.Cut(v, ",")
+			return strings.TrimSpace(ip)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// アカウント名は任意の文字列なので、memcachedのキーに使えるようハッシュにする
+func rateLimitKey(rule, scope, value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return rule + "_" + scope + "_" + hex.EncodeToString(sum[:16])
+}
+
+func rateLimit(rule rateLimitRule) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if rateLimiter == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ok, wait := allowRequest(rule, "ip", clientIP(r), rule.perIP)
+			if ok && rule.account != nil {
+				if account := rule.account(r); account != "" {
+					ok, wait = allowRequest(rule, "account", account, rule.perAccount)
+				}
+			}
+			if ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			if rule.redirect != "" {
+				session := getSession(r)
+				session.Values["notice"] = "リクエストが多すぎます。しばらくしてからもう一度お試しください"
+				session.Save(r, w)
+
+				http.Redirect(w, r, rule.redirect, http.StatusFound)
+				return
+			}
+			renderError(w, r, http.StatusTooManyRequests, "リクエストが多すぎます。しばらくしてからもう一度お試しください")
+		})
+	}
+}
+
+// Allowのエラーはログに残すだけにする
+func allowRequest(rule rateLimitRule, scope, value string, limit ratelimit.Limit) (bool, time.Duration) {
+	ok, wait, err := rateLimiter.Allow(rateLimitKey(rule.name, scope, value), limit)
+	if err != nil {
+		log.Print(err)
+	}
+	if !ok {
+		rateLimitedTotal.WithLabelValues(rule.name, scope).Inc()
+	}
+	return ok, wait
+}
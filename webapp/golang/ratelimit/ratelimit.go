@@ -0,0 +1,139 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// 他のプロセスと同時に更新したときに読み直す回数
+const casRetries = 5
+
+var errContended = errors.New("ratelimit: too many concurrent updates")
+
+// バケツの容量と、1秒あたりに補充するトークンの数
+type Limit struct {
+	Burst int
+	Rate  float64
+}
+
+// 1分あたりn回。最大burst回まで続けて使える
+func PerMinute(n, burst int) Limit {
+	return Limit{Burst: burst, Rate: float64(n) / 60}
+}
+
+// バケツがいっぱいになるまでの時間。それより古い状態は満タンと同じなので捨ててよい
+func (l Limit) fillDuration() time.Duration {
+	return time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+}
+
+// Limiterが使うmemcachedの操作。*memcache.Clientが満たす
+type client interface {
+	Get(key string) (*memcache.Item, error)
+	Add(item *memcache.Item) error
+	CompareAndSwap(item *memcache.Item) error
+}
+
+// トークンバケツ。状態はmemcachedに置き、複数のアプリケーションサーバーで共有する
+// 値は「残りトークン数 最終更新時刻(UnixNano)」の文字列で、CASで更新する
+type Limiter struct {
+	mc     client
+	prefix string
+	now    func() time.Time
+}
+
+func New(mc *memcache.Client, prefix string) *Limiter {
+	return &Limiter{mc: mc, prefix: prefix, now: time.Now}
+}
+
+// keyのバケツからトークンを1つ取り出す
+// 取り出せなかったときは、次に1つ補充されるまでの時間を返す
+// memcachedに届かないときは制限しない。errを見てログに残すこと
+// 同じキーの更新が競合し続けたときは、errとともに制限したものとして返す
+func (l *Limiter) Allow(key string, limit Limit) (bool, time.Duration, error) {
+	if limit.Burst <= 0 || limit.Rate <= 0 {
+		return true, 0, nil
+	}
+
+	key = l.prefix + key
+	for i := 0; i < casRetries; i++ {
+		now := l.now()
+
+		item, err := l.mc.Get(key)
+		if errors.Is(err, memcache.ErrCacheMiss) {
+			err = l.mc.Add(&memcache.Item{
+				Key:        key,
+				Value:      encode(float64(limit.Burst-1), now),
+				Expiration: expiration(limit),
+			})
+			if errors.Is(err, memcache.ErrNotStored) {
+				continue
+			}
+			if err != nil {
+				return true, 0, err
+			}
+			return true, 0, nil
+		}
+		if err != nil {
+			return true, 0, err
+		}
+
+		tokens, updatedAt, err := decode(item.Value)
+		if err != nil {
+			// 壊れた値は満タンとして扱う
+			tokens, updatedAt = float64(limit.Burst), now
+		}
+		if elapsed := now.Sub(updatedAt); elapsed > 0 {
+			tokens = math.Min(float64(limit.Burst), tokens+elapsed.Seconds()*limit.Rate)
+		}
+
+		if tokens < 1 {
+			wait := time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+			return false, wait, nil
+		}
+
+		item.Value = encode(tokens-1, now)
+		item.Expiration = expiration(limit)
+		err = l.mc.CompareAndSwap(item)
+		if errors.Is(err, memcache.ErrCASConflict) || errors.Is(err, memcache.ErrNotStored) {
+			continue
+		}
+		if err != nil {
+			return true, 0, err
+		}
+		return true, 0, nil
+	}
+
+	// 同時に大量に来ているので、通さずに少し待たせる
+	return false, time.Second, fmt.Errorf("%w: %s", errContended, key)
+}
+
+func encode(tokens float64, at time.Time) []byte {
+	return []byte(strconv.FormatFloat(tokens, 'f', -1, 64) + " " + strconv.FormatInt(at.UnixNano(), 10))
+}
+
+func decode(b []byte) (float64, time.Time, error) {
+	t, at, ok := strings.Cut(string(b), " ")
+	if !ok {
+		return 0, time.Time{}, errors.New("ratelimit: malformed value")
+	}
+	tokens, err := strconv.ParseFloat(t, 64)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	nsec, err := strconv.ParseInt(at, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return tokens, time.Unix(0, nsec), nil
+}
+
+// memcachedの有効期限は秒単位。切り上げて1秒足しておく
+func expiration(limit Limit) int32 {
+	return int32(math.Ceil(limit.fillDuration().Seconds())) + 1
+}
@@ -0,0 +1,298 @@
+package ratelimit
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// CASを再現するmemcached。Getで返したItemごとに読んだ時点の版を覚えておく
+type fakeClient struct {
+	mu       sync.Mutex
+	values   map[string][]byte
+	versions map[string]int
+	read     map[*memcache.Item]int
+	// AddとCompareAndSwapの前に呼ぶ。他のプロセスが先に書き換えたことにできる
+	beforeAdd func(key string)
+	beforeCAS func(key string)
+	// nilでなければ、すべての操作でこのエラーを返す
+	err error
+
+	casCalls int
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		values:   map[string][]byte{},
+		versions: map[string]int{},
+		read:     map[*memcache.Item]int{},
+	}
+}
+
+func (c *fakeClient) Get(key string) (*memcache.Item, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+	v, ok := c.values[key]
+	if !ok {
+		return nil, memcache.ErrCacheMiss
+	}
+	item := &memcache.Item{Key: key, Value: append([]byte(nil), v...)}
+	c.read[item] = c.versions[key]
+	return item, nil
+}
+
+func (c *fakeClient) Add(item *memcache.Item) error {
+	if c.beforeAdd != nil {
+		c.beforeAdd(item.Key)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+	if _, ok := c.values[item.Key]; ok {
+		return memcache.ErrNotStored
+	}
+	c.values[item.Key] = item.Value
+	c.versions[item.Key]++
+	return nil
+}
+
+func (c *fakeClient) CompareAndSwap(item *memcache.Item) error {
+	if c.beforeCAS != nil {
+		c.beforeCAS(item.Key)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.casCalls++
+	if c.err != nil {
+		return c.err
+	}
+	if _, ok := c.values[item.Key]; !ok {
+		return memcache.ErrNotStored
+	}
+	if c.read[item] != c.versions[item.Key] {
+		return memcache.ErrCASConflict
+	}
+	c.values[item.Key] = item.Value
+	c.versions[item.Key]++
+	return nil
+}
+
+// 他のプロセスがトークンを1つ使ったことにする
+func (c *fakeClient) consume(key string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tokens, _, _ := decode(c.values[key])
+	c.values[key] = encode(tokens-1, now)
+	c.versions[key]++
+}
+
+func (c *fakeClient) set(key string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[key] = value
+	c.versions[key]++
+}
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func newTestLimiter() (*Limiter, *fakeClient, *clock) {
+	mc := newFakeClient()
+	clk := &clock{now: time.Unix(1700000000, 0)}
+	return &Limiter{mc: mc, prefix: "test_", now: clk.Now}, mc, clk
+}
+
+func TestAllow(t *testing.T) {
+	// 1分に6回 (10秒に1つ補充)、最大3回まで続けて使える
+	limit := PerMinute(6, 3)
+
+	type step struct {
+		// 前のリクエストからの経過時間
+		after    time.Duration
+		wantOK   bool
+		wantWait time.Duration
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "burst then deny",
+			steps: []step{
+				{0, true, 0},
+				{0, true, 0},
+				{0, true, 0},
+				{0, false, 10 * time.Second},
+				{0, false, 10 * time.Second},
+			},
+		},
+		{
+			name: "refill one token",
+			steps: []step{
+				{0, true, 0},
+				{0, true, 0},
+				{0, true, 0},
+				{4 * time.Second, false, 6 * time.Second},
+				{6 * time.Second, true, 0},
+				{0, false, 10 * time.Second},
+			},
+		},
+		{
+			name: "refill does not exceed burst",
+			steps: []step{
+				{0, true, 0},
+				{time.Hour, true, 0},
+				{0, true, 0},
+				{0, true, 0},
+				{0, false, 10 * time.Second},
+			},
+		},
+		{
+			name: "steady rate is allowed",
+			steps: []step{
+				{0, true, 0},
+				{10 * time.Second, true, 0},
+				{10 * time.Second, true, 0},
+				{10 * time.Second, true, 0},
+				{10 * time.Second, true, 0},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _, clk := newTestLimiter()
+			for i, s := range tt.steps {
+				clk.now = clk.now.Add(s.after)
+				ok, wait, err := l.Allow("key", limit)
+				if err != nil {
+					t.Fatalf("step %d: unexpected error %v", i, err)
+				}
+				// 待ち時間は浮動小数点で計算するので、1ミリ秒までの誤差は許す
+				if d := wait - s.wantWait; ok != s.wantOK || d < -time.Millisecond || d > time.Millisecond {
+					t.Errorf("step %d: got (%v, %v), want (%v, %v)", i, ok, wait, s.wantOK, s.wantWait)
+				}
+			}
+		})
+	}
+}
+
+func TestAllow_keysAreIndependent(t *testing.T) {
+	l, _, _ := newTestLimiter()
+	limit := PerMinute(1, 1)
+
+	if ok, _, _ := l.Allow("a", limit); !ok {
+		t.Fatal("expected the first request for a to be allowed")
+	}
+	if ok, _, _ := l.Allow("a", limit); ok {
+		t.Error("expected the second request for a to be denied")
+	}
+	if ok, _, _ := l.Allow("b", limit); !ok {
+		t.Error("expected the first request for b to be allowed")
+	}
+}
+
+func TestAllow_casConflict(t *testing.T) {
+	tests := []struct {
+		name  string
+		burst int
+		// 何回目までのCompareAndSwapの前に他のプロセスがトークンを使うか
+		conflicts    int
+		wantOK       bool
+		wantErr      error
+		wantCASCalls int
+		// 自分と他のプロセスが使った後の残り
+		wantTokens float64
+	}{
+		{"no conflict", 10, 0, true, nil, 1, 8},
+		{"retry once", 10, 1, true, nil, 2, 7},
+		{"retry until the last attempt", 10, casRetries - 1, true, nil, casRetries, float64(9 - casRetries)},
+		{"give up", 10, casRetries, false, errContended, casRetries, float64(9 - casRetries)},
+		{"others drain the bucket", 3, 2, false, nil, 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, mc, clk := newTestLimiter()
+			limit := PerMinute(6, tt.burst)
+			// 満タンより1つ少ない状態から始める
+			if ok, _, err := l.Allow("key", limit); !ok || err != nil {
+				t.Fatalf("setup: got (%v, %v)", ok, err)
+			}
+
+			n := 0
+			mc.beforeCAS = func(key string) {
+				n++
+				if n <= tt.conflicts {
+					mc.consume(key, clk.now)
+				}
+			}
+
+			ok, _, err := l.Allow("key", limit)
+			if ok != tt.wantOK {
+				t.Errorf("got ok=%v, want %v", ok, tt.wantOK)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got err=%v, want %v", err, tt.wantErr)
+			}
+			if mc.casCalls != tt.wantCASCalls {
+				t.Errorf("got %d CompareAndSwap calls, want %d", mc.casCalls, tt.wantCASCalls)
+			}
+			tokens, _, _ := decode(mc.values["test_key"])
+			if tokens != tt.wantTokens {
+				t.Errorf("got %v tokens left, want %v", tokens, tt.wantTokens)
+			}
+		})
+	}
+}
+
+// 最初のリクエストが同時に来てAddで負けた側は、読み直して勝った側のバケツから取り出す
+func TestAllow_addRace(t *testing.T) {
+	l, mc, clk := newTestLimiter()
+	limit := PerMinute(6, 3)
+
+	mc.beforeAdd = func(key string) {
+		mc.set(key, encode(1, clk.now))
+	}
+	ok, _, err := l.Allow("key", limit)
+	if !ok || err != nil {
+		t.Fatalf("got (%v, %v), want (true, nil)", ok, err)
+	}
+	if tokens, _, _ := decode(mc.values["test_key"]); tokens != 0 {
+		t.Errorf("got %v tokens left, want 0", tokens)
+	}
+
+	ok, _, err = l.Allow("key", limit)
+	if ok || err != nil {
+		t.Errorf("got (%v, %v), want (false, nil)", ok, err)
+	}
+}
+
+// memcachedに届かないときは通す
+func TestAllow_failOpen(t *testing.T) {
+	l, mc, _ := newTestLimiter()
+	mc.err = errors.New("connection refused")
+
+	ok, _, err := l.Allow("key", PerMinute(1, 1))
+	if !ok || err == nil {
+		t.Errorf("got (%v, %v), want (true, error)", ok, err)
+	}
+}
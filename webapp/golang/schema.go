@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// 初期データのダンプにはないテーブル・カラム・インデックス
+// postsへのALTERは画像のblobごとテーブルを作り直して時間がかかるので、/initializeではなく起動時に一度だけ流す
+type schemaChange struct {
+	// table, column, index のどれがあれば適用済みとみなすか
+	kind  string
+	table string
+	name  string
+	ddl   string
+}
+
+var schemaChanges = []schemaChange{
+	{"index", "comments", "post_id_index", "ALTER TABLE `comments` ADD INDEX `post_id_index` (`post_id`, `created_at` DESC)"},
+	{"index", "comments", "user_id_index", "ALTER TABLE `comments` ADD INDEX `user_id_index` (`user_id`)"},
+	{"index", "posts", "created_at_index", "ALTER TABLE `posts` ADD INDEX `created_at_index` (`created_at` DESC)"},
+	{"index", "posts", "user_id_created_at_index", "ALTER TABLE `posts` ADD INDEX `user_id_created_at_index` (`user_id`, `created_at` DESC)"},
+	{"column", "posts", "hidden_at", "ALTER TABLE `posts` ADD COLUMN `hidden_at` datetime DEFAULT NULL, ADD COLUMN `hidden_reason` varchar(255) NOT NULL DEFAULT ''"},
+	{"column", "comments", "hidden_at", "ALTER TABLE `comments` ADD COLUMN `hidden_at` datetime DEFAULT NULL, ADD COLUMN `hidden_reason` varchar(255) NOT NULL DEFAULT ''"},
+	{"index", "posts", "body_fulltext_index", "ALTER TABLE `posts` ADD FULLTEXT INDEX `body_fulltext_index` (`body`) WITH PARSER ngram"},
+	{"index", "comments", "comment_fulltext_index", "ALTER TABLE `comments` ADD FULLTEXT INDEX `comment_fulltext_index` (`comment`) WITH PARSER ngram"},
+	{"table", "post_image_variants", "", "CREATE TABLE `post_image_variants` (`post_id` int NOT NULL, `width` int NOT NULL, `imgdata` mediumblob NOT NULL, PRIMARY KEY (`post_id`, `width`)) DEFAULT CHARSET=utf8mb4"},
+	{"table", "moderation_logs", "", "CREATE TABLE `moderation_logs` (`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY, `admin_id` int NOT NULL, `user_id` int NOT NULL, `action` varchar(16) NOT NULL, `reason` varchar(255) NOT NULL DEFAULT '', `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, KEY `created_at_index` (`created_at` DESC)) DEFAULT CHARSET=utf8mb4"},
+	{"column", "moderation_logs", "content_id", "ALTER TABLE `moderation_logs` ADD COLUMN `content_id` int NOT NULL DEFAULT 0"},
+	{"table", "likes", "", "CREATE TABLE `likes` (`post_id` int NOT NULL, `user_id` int NOT NULL, `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (`post_id`, `user_id`), KEY `user_id_index` (`user_id`)) DEFAULT CHARSET=utf8mb4"},
+	{"table", "tags", "", "CREATE TABLE `tags` (`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY, `name` varchar(64) NOT NULL COLLATE utf8mb4_bin, UNIQUE KEY `name_index` (`name`)) DEFAULT CHARSET=utf8mb4"},
+	{"table", "post_tags", "", "CREATE TABLE `post_tags` (`tag_id` int NOT NULL, `post_id` int NOT NULL, PRIMARY KEY (`tag_id`, `post_id`), KEY `post_id_index` (`post_id`)) DEFAULT CHARSET=utf8mb4"},
+	{"table", "notifications", "", "CREATE TABLE `notifications` (`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY, `user_id` int NOT NULL, `actor_id` int NOT NULL, `kind` varchar(16) NOT NULL, `post_id` int NOT NULL, `comment_id` int NOT NULL, `read_at` datetime DEFAULT NULL, `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, KEY `user_id_created_at_index` (`user_id`, `created_at` DESC), KEY `user_id_read_at_index` (`user_id`, `read_at`)) DEFAULT CHARSET=utf8mb4"},
+	{"table", "follows", "", "CREATE TABLE `follows` (`follower_id` int NOT NULL, `followee_id` int NOT NULL, `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (`follower_id`, `followee_id`), KEY `followee_id_index` (`followee_id`, `created_at` DESC)) DEFAULT CHARSET=utf8mb4"},
+}
+
+func (c schemaChange) applied() (bool, error) {
+	var query string
+	args := []interface{}{c.table}
+	switch c.kind {
+	case "table":
+		query = "SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?"
+	case "column":
+		query = "SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?"
+		args = append(args, c.name)
+	case "index":
+		query = "SELECT COUNT(*) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?"
+		args = append(args, c.name)
+	default:
+		return false, fmt.Errorf("unknown schema change kind %q", c.kind)
+	}
+
+	count := 0
+	err := db.Get(&count, query, args...)
+	return count > 0, err
+}
+
+// 適用していない変更だけを流す
+// 複数のアプリケーションサーバーが同時に起動して先を越されたときは、流し終えたあとに確かめ直す
+func migrateSchema() error {
+	for _, c := range schemaChanges {
+		ok, err := c.applied()
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+
+		log.Printf("applying schema change: %s", c.ddl)
+		_, err = db.Exec(c.ddl)
+		if err != nil {
+			if ok, _ := c.applied(); ok {
+				continue
+			}
+			return fmt.Errorf("%s: %w", c.ddl, err)
+		}
+	}
+	return nil
+}
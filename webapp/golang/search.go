@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+const searchQueryMaxLength = 100
+
+// 検索語をBOOLEAN MODEのクエリにする
+// 空白で区切った語をそれぞれフレーズとして扱い、すべてを含むものに絞る
+// ngramパーサーはフレーズを連続したngramとして照合するので、日本語や顔文字もそのまま探せる
+func booleanQuery(q string) string {
+	var terms []string
+	for _, term := range strings.Fields(q) {
+		term = strings.ReplaceAll(term, `"`, "")
+		if term == "" {
+			continue
+		}
+		terms = append(terms, `+"`+term+`"`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// 本文か、表示中のコメントに検索語を含む投稿。BANされたユーザーの投稿とコメントは含めない
+func fetchSearchPosts(q string, cursor *Cursor) ([]Post, error) {
+	match := booleanQuery(q)
+	if match == "" {
+		return []Post{}, nil
+	}
+
+	cond, args := cursorCondition(cursor)
+
+	results := []PostUser{}
+	// ORでつなぐとpostsのFULLTEXTインデックスが使われないので、それぞれで探した投稿IDをUNIONする
+	query := postUserSelect + `
+	FROM (
+		SELECT posts.id
+		FROM posts
+		WHERE MATCH (posts.body) AGAINST (? IN BOOLEAN MODE)
+		UNION
+		SELECT comments.post_id
+		FROM comments
+		JOIN users AS commenters
+		ON commenters.id = comments.user_id
+		WHERE MATCH (comments.comment) AGAINST (? IN BOOLEAN MODE)
+		AND comments.hidden_at IS NULL
+		AND commenters.del_flg = 0
+	) AS matched
+	JOIN posts
+	ON posts.id = matched.id
+	JOIN users
+	ON users.id = posts.user_id
+	WHERE users.del_flg = 0
+	AND posts.hidden_at IS NULL
+	` + cond + `
+	ORDER BY posts.created_at DESC, posts.id DESC
+	LIMIT ?
+	`
+	args = append([]interface{}{match, match}, args...)
+	err := db.Select(&results, query, append(args, postsPerPage)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return fastMakePosts(results, false)
+}
+
+// 前後の空白を除いた検索語。長すぎるときはエラー
+func searchQuery(r *http.Request) (string, error) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if utf8.RuneCountInString(q) > searchQueryMaxLength {
+		return "", validationError("検索語が長すぎます")
+	}
+	return q, nil
+}
+
+func searchPath(basePath, q string) string {
+	return basePath + "?q=" + url.QueryEscape(q)
+}
+
+func getSearch(w http.ResponseWriter, r *http.Request) error {
+	q, err := searchQuery(r)
+	if err != nil {
+		return err
+	}
+
+	posts := []Post{}
+	if q != "" {
+		posts, err = fetchSearchPosts(q, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	me := getSessionUser(r)
+	posts, err = withViewer(posts, getCSRFToken(r), me)
+	if err != nil {
+		return err
+	}
+
+	return templates.Execute(w, "search", struct {
+		Query string
+		Posts PostList
+		Me    User
+	}{q, newPostList(posts, searchPath("/search/posts", q)), me})
+}
+
+// 検索結果の「もっと見る」
+func getSearchPosts(w http.ResponseWriter, r *http.Request) error {
+	q, err := searchQuery(r)
+	if err != nil {
+		return err
+	}
+	if q == "" {
+		return badRequestError("qが必要です", nil)
+	}
+
+	return renderMorePosts(w, r, searchPath("/search/posts", q), func(cursor *Cursor) ([]Post, error) {
+		return fetchSearchPosts(q, cursor)
+	})
+}
+
+func apiGetSearch(w http.ResponseWriter, r *http.Request) {
+	q, err := searchQuery(r)
+	if err != nil || q == "" {
+		writeJSONError(w, http.StatusBadRequest)
+		return
+	}
+
+	cursor, err := apiCursor(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest)
+		return
+	}
+
+	posts, err := fetchSearchPosts(q, cursor)
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError)
+		return
+	}
+
+	posts, err = withViewer(posts, "", getSessionUser(r))
+	if err != nil {
+		log.Print(err)
+		writeJSONError(w, http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPIPostList(posts, searchPath("/api/v1/search", q)))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	gsm "github.com/bradleypeabody/gorilla-sessions-memcache"
+	"github.com/catatsuy/private-isu/webapp/golang/sessionstore"
+	"github.com/gorilla/sessions"
+)
+
+// カンマ区切りの秘密鍵。空の要素は無視する
+func splitSecrets(s string) []string {
+	var secrets []string
+	for _, secret := range strings.Split(s, ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// memcached (デフォルト) はセッションIDだけをクッキーに入れ、中身はmemcachedに置く
+// cookie は中身ごと暗号化してクッキーに入れるので、リクエストごとのmemcachedへの問い合わせがない
+// ただしサーバー側で無効にできないので、ログアウト前のクッキーも期限までは使えてしまう
+// memory はプロセス内に置く。開発やアプリケーションサーバーが1台のとき向け
+func newSessionStore(cfg *Config, kind string) (sessions.Store, error) {
+	secrets := splitSecrets(cfg.SessionSecrets)
+	switch kind {
+	case "", "memcached":
+		return gsm.NewMemcacheStore(mc, "iscogram_", sessionstore.KeyPairs(secrets, false)...), nil
+	case "cookie":
+		return sessions.NewCookieStore(sessionstore.KeyPairs(secrets, true)...), nil
+	case "memory":
+		return sessionstore.NewMemoryStore(sessionstore.KeyPairs(secrets, false)...), nil
+	}
+	return nil, fmt.Errorf("unknown session store %q", kind)
+}
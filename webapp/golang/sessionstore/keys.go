@@ -0,0 +1,20 @@
+package sessionstore
+
+import "crypto/sha256"
+
+// securecookieに渡す鍵の組を秘密鍵から作る
+// 先頭の秘密鍵で署名・暗号化し、残りは検証と復号だけに使うので、先頭に新しい鍵を足せば入れ替えられる
+// 署名の鍵は秘密鍵そのもの。以前からのクッキーをそのまま検証できるように変えない
+// encryptなら、秘密鍵から導いたAES-256の鍵も付ける
+func KeyPairs(secrets []string, encrypt bool) [][]byte {
+	pairs := make([][]byte, 0, len(secrets)*2)
+	for _, secret := range secrets {
+		var blockKey []byte
+		if encrypt {
+			sum := sha256.Sum256([]byte("isuconp session encryption:" + secret))
+			blockKey = sum[:]
+		}
+		pairs = append(pairs, []byte(secret), blockKey)
+	}
+	return pairs
+}
@@ -0,0 +1,137 @@
+package sessionstore
+
+import (
+	"encoding/base32"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// 期限切れのセッションをまとめて消す間隔
+const sweepInterval = time.Minute
+
+// プロセス内のmapにセッションを置く。クッキーには署名したセッションIDだけを入れる
+// 再起動で消え、複数のプロセスでは共有できないので、開発やアプリケーションサーバーが1台のとき向け
+type MemoryStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+
+	mu        sync.Mutex
+	sessions  map[string]memorySession
+	lastSweep time.Time
+}
+
+type memorySession struct {
+	values  map[interface{}]interface{}
+	expires time.Time
+}
+
+func NewMemoryStore(keyPairs ...[]byte) *MemoryStore {
+	return &MemoryStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		sessions:  map[string]memorySession{},
+		lastSweep: time.Now(),
+	}
+}
+
+// 同じリクエストの中では最初に読んだセッションを使い回す
+func (s *MemoryStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *MemoryStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	err = securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...)
+	if err != nil {
+		return session, err
+	}
+
+	if values, ok := s.load(session.ID); ok {
+		session.Values = values
+		session.IsNew = false
+	}
+	return session, nil
+}
+
+// MaxAgeが負なら削除する
+func (s *MemoryStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		s.delete(session.ID)
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+	s.store(session.ID, session.Values, time.Duration(session.Options.MaxAge)*time.Second)
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// 返した値はリクエストの中で書き換えられるのでコピーを渡す
+func (s *MemoryStore) load(id string) (map[interface{}]interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ms, ok := s.sessions[id]
+	if !ok || time.Now().After(ms.expires) {
+		return nil, false
+	}
+	return copyValues(ms.values), true
+}
+
+func (s *MemoryStore) store(id string, values map[interface{}]interface{}, ttl time.Duration) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[id] = memorySession{values: copyValues(values), expires: now.Add(ttl)}
+
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	for id, ms := range s.sessions {
+		if now.After(ms.expires) {
+			delete(s.sessions, id)
+		}
+	}
+	s.lastSweep = now
+}
+
+func (s *MemoryStore) delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, id)
+}
+
+func copyValues(values map[interface{}]interface{}) map[interface{}]interface{} {
+	c := make(map[interface{}]interface{}, len(values))
+	for k, v := range values {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// ハッシュタグは # に続く文字・数字・_ の並び。tagsテーブルのnameに合わせて長さを制限する
+const tagMaxLength = 64
+
+const tagPattern = `[\p{L}\p{N}_]+`
+
+var (
+	tagRegexp     = regexp.MustCompile(`#` + tagPattern)
+	tagNameRegexp = regexp.MustCompile(`\A` + tagPattern + `\z`)
+)
+
+// 大文字小文字の違いは同じタグとして扱う
+func normalizeTag(tag string) string {
+	return strings.ToLower(tag)
+}
+
+func isValidTag(tag string) bool {
+	return utf8.RuneCountInString(tag) <= tagMaxLength && tagNameRegexp.MatchString(tag)
+}
+
+func tagURL(tag string) string {
+	return "/tags/" + url.PathEscape(normalizeTag(tag))
+}
+
+// 本文中の #tag の位置。"foo#bar" や "&#123;" のように直前が単語の途中ならタグにしない
+func findTags(text string) [][]int {
+	var locs [][]int
+	for _, loc := range tagRegexp.FindAllStringIndex(text, -1) {
+		if inWord(text, loc[0]) || strings.HasSuffix(text[:loc[0]], "&") {
+			continue
+		}
+		if !isValidTag(text[loc[0]+1 : loc[1]]) {
+			continue
+		}
+		locs = append(locs, loc)
+	}
+	return locs
+}
+
+// 本文に含まれるタグを正規化し、重複を除いて返す
+func extractTags(text string) []string {
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, loc := range findTags(text) {
+		tag := normalizeTag(text[loc[0]+1 : loc[1]])
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+func tagLinks(text string) []textLink {
+	var links []textLink
+	for _, loc := range findTags(text) {
+		links = append(links, textLink{start: loc[0], end: loc[1], href: tagURL(text[loc[0]+1 : loc[1]]), class: "isu-tag"})
+	}
+	return links
+}
+
+// 本文をエスケープし、タグだけタグページへのリンクにする
+func linkTags(text string) template.HTML {
+	return renderLinks(text, tagLinks(text))
+}
+
+// 投稿本文とコメントのタグを投稿に紐付ける
+func saveTags(postID int, text string) error {
+	tags := extractTags(text)
+	if len(tags) == 0 {
+		return nil
+	}
+
+	values := make([]string, len(tags))
+	args := make([]interface{}, len(tags))
+	for i, tag := range tags {
+		values[i] = "(?)"
+		args[i] = tag
+	}
+	_, err := db.Exec("INSERT IGNORE INTO `tags` (`name`) VALUES "+strings.Join(values, ","), args...)
+	if err != nil {
+		return err
+	}
+
+	query, args, err := sqlx.In("SELECT `id` FROM `tags` WHERE `name` IN (?)", tags)
+	if err != nil {
+		return err
+	}
+	tagIDs := []int{}
+	err = db.Select(&tagIDs, query, args...)
+	if err != nil {
+		return err
+	}
+
+	values = values[:0]
+	args = args[:0]
+	for _, id := range tagIDs {
+		values = append(values, "(?,?)")
+		args = append(args, id, postID)
+	}
+	_, err = db.Exec("INSERT IGNORE INTO `post_tags` (`tag_id`, `post_id`) VALUES "+strings.Join(values, ","), args...)
+	return err
+}
+
+func fetchTagPosts(tag string, cursor *Cursor) ([]Post, error) {
+	cond, args := cursorCondition(cursor)
+
+	results := []PostUser{}
+	query := postUserSelect + `
+	FROM tags
+	JOIN post_tags
+	ON post_tags.tag_id = tags.id
+	JOIN posts
+	ON posts.id = post_tags.post_id
+	JOIN users
+	ON users.id = posts.user_id
+	WHERE tags.name = ?
+	AND users.del_flg = 0
+	AND posts.hidden_at IS NULL
+	` + cond + `
+	ORDER BY posts.created_at DESC, posts.id DESC
+	LIMIT ?
+	`
+	args = append([]interface{}{tag}, args...)
+	err := db.Select(&results, query, append(args, postsPerPage)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return fastMakePosts(results, false)
+}
+
+// URLのタグを正規化して検証する
+func tagParam(r *http.Request) (string, error) {
+	tag := normalizeTag(chi.URLParam(r, "tag"))
+	if !isValidTag(tag) {
+		return "", notFoundError("タグが見つかりません")
+	}
+	return tag, nil
+}
+
+func getTag(w http.ResponseWriter, r *http.Request) error {
+	tag, err := tagParam(r)
+	if err != nil {
+		return err
+	}
+
+	posts, err := fetchTagPosts(tag, nil)
+	if err != nil {
+		return err
+	}
+
+	me := getSessionUser(r)
+	posts, err = withViewer(posts, getCSRFToken(r), me)
+	if err != nil {
+		return err
+	}
+
+	return templates.Execute(w, "tag", struct {
+		Tag   string
+		Posts PostList
+		Me    User
+	}{tag, newPostList(posts, tagURL(tag)+"/posts"), me})
+}
+
+// タグページの「もっと見る」
+func getTagPosts(w http.ResponseWriter, r *http.Request) error {
+	tag, err := tagParam(r)
+	if err != nil {
+		return err
+	}
+
+	return renderMorePosts(w, r, tagURL(tag)+"/posts", func(cursor *Cursor) ([]Post, error) {
+		return fetchTagPosts(tag, cursor)
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"html/template"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractTags(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"none", "タグのない本文", []string{}},
+		{"single", "#isucon", []string{"isucon"}},
+		{"japanese", "今日は #ラーメン と #東京タワー", []string{"ラーメン", "東京タワー"}},
+		{"other scripts", "#café #Ελλάδα #한국 #٣٤", []string{"café", "ελλάδα", "한국", "٣٤"}},
+		{"digits and underscore", "#2024_summer", []string{"2024_summer"}},
+		{"trailing punctuation", "#go, #mysql. #nginx! (#php) #ruby?", []string{"go", "mysql", "nginx", "php", "ruby"}},
+		{"japanese punctuation", "#寿司。#天ぷら、#そば！", []string{"寿司", "天ぷら", "そば"}},
+		{"trailing hyphen", "#foo-bar", []string{"foo"}},
+		{"duplicates", "#go #Go #GO #go", []string{"go"}},
+		{"order kept", "#b #a #b #c", []string{"b", "a", "c"}},
+		{"adjacent", "#foo#bar", []string{"foo"}},
+		{"inside a word", "foo#bar C#", []string{}},
+		{"after japanese text", "今日は#晴れ", []string{}},
+		{"after newline", "line\n#tag", []string{"tag"}},
+		{"html entity", "&#123; &#x41;", []string{}},
+		{"lone hash", "# #", []string{}},
+		{"max length", "#" + strings.Repeat("あ", tagMaxLength), []string{strings.Repeat("あ", tagMaxLength)}},
+		{"too long", "#" + strings.Repeat("あ", tagMaxLength+1), []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractTags(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extractTags(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLinkTags(t *testing.T) {
+	tests := []struct {
+		text string
+		want template.HTML
+	}{
+		{"#Go!", `<a href="/tags/go" class="isu-tag">#Go</a>!`},
+		{"#ラーメン", `<a href="/tags/%E3%83%A9%E3%83%BC%E3%83%A1%E3%83%B3" class="isu-tag">#ラーメン</a>`},
+		{"<b>#tag</b>", `&lt;b&gt;<a href="/tags/tag" class="isu-tag">#tag</a>&lt;/b&gt;`},
+		{"&#tag", `&amp;#tag`},
+	}
+	for _, tt := range tests {
+		if got := linkTags(tt.text); got != tt.want {
+			t.Errorf("linkTags(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
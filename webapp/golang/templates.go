@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// ページ名と、そのページを組み立てるテンプレートファイル
+// 先頭のファイルがExecuteの起点になる
+var pageTemplates = map[string][]string{
+	"login":         {"layout.html", "login.html"},
+	"register":      {"layout.html", "register.html"},
+	"index":         {"layout.html", "index.html", "posts.html", "post.html"},
+	"user":          {"layout.html", "user.html", "posts.html", "post.html"},
+	"posts":         {"posts.html", "post.html"},
+	"post_id":       {"layout.html", "post_id.html", "post.html"},
+	"banned":        {"layout.html", "banned.html"},
+	"audit":         {"layout.html", "audit.html"},
+	"hidden":        {"layout.html", "hidden.html"},
+	"follows":       {"layout.html", "follows.html"},
+	"following":     {"layout.html", "following.html", "posts.html", "post.html"},
+	"tag":           {"layout.html", "tag.html", "posts.html", "post.html"},
+	"search":        {"layout.html", "search.html", "posts.html", "post.html"},
+	"notifications": {"layout.html", "notifications.html"},
+	"error":         {"layout.html", "error.html"},
+}
+
+var templateFuncs = template.FuncMap{
+	"imageURL":    imageURL,
+	"imageSrcset": imageSrcset,
+	"accountURL":  accountURL,
+	"linkTags":    linkTags,
+	"linkComment": linkComment,
+}
+
+// 起動時にすべてのページをパースしておく
+// reloadが有効なら描画のたびにファイルの更新を確認し、変わっていれば全部パースし直す
+type templateRegistry struct {
+	reload bool
+
+	mu       sync.RWMutex
+	pages    map[string]*template.Template
+	parsedAt time.Time
+}
+
+var templates *templateRegistry
+
+func loadTemplates(reload bool) (*templateRegistry, error) {
+	pages, err := parsePageTemplates()
+	if err != nil {
+		return nil, err
+	}
+	return &templateRegistry{
+		reload:   reload,
+		pages:    pages,
+		parsedAt: time.Now(),
+	}, nil
+}
+
+func parsePageTemplates() (map[string]*template.Template, error) {
+	pages := make(map[string]*template.Template, len(pageTemplates))
+	for name, files := range pageTemplates {
+		paths := make([]string, 0, len(files))
+		for _, f := range files {
+			paths = append(paths, getTemplPath(f))
+		}
+		t, err := template.New(files[0]).Funcs(templateFuncs).ParseFiles(paths...)
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %w", name, err)
+		}
+		pages[name] = t
+	}
+	return pages, nil
+}
+
+func (t *templateRegistry) Execute(w io.Writer, name string, data interface{}) error {
+	if t.reload {
+		t.reloadIfChanged()
+	}
+
+	t.mu.RLock()
+	tmpl, ok := t.pages[name]
+	t.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("template %s is not registered", name)
+	}
+	return tmpl.Execute(w, data)
+}
+
+// 開発用。パースに失敗したときは前の状態のまま使い続ける
+func (t *templateRegistry) reloadIfChanged() {
+	t.mu.RLock()
+	parsedAt := t.parsedAt
+	t.mu.RUnlock()
+
+	if !templatesModifiedSince(parsedAt) {
+		return
+	}
+
+	now := time.Now()
+	pages, err := parsePageTemplates()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	t.mu.Lock()
+	t.pages = pages
+	t.parsedAt = now
+	t.mu.Unlock()
+}
+
+func templatesModifiedSince(since time.Time) bool {
+	seen := map[string]bool{}
+	for _, files := range pageTemplates {
+		for _, f := range files {
+			if seen[f] {
+				continue
+			}
+			seen[f] = true
+
+			info, err := os.Stat(getTemplPath(f))
+			if err != nil || info.ModTime().After(since) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -34,8 +34,15 @@ document.addEventListener('DOMContentLoaded', () => {
     postMore.classList.add('loading');
     const posts = document.querySelectorAll('.isu-post');
     const lastEl = posts[posts.length-1];
-    const maxCreatedAt = lastEl.dataset.createdAt;
-    fetch(`/posts?max_created_at=${encodeURIComponent(maxCreatedAt)}`, {
+    const nextLinks = document.querySelectorAll('.isu-posts-next');
+    let nextURL;
+    if (nextLinks.length > 0) {
+      nextURL = nextLinks[nextLinks.length-1].getAttribute('href');
+    } else {
+      const maxCreatedAt = lastEl.dataset.createdAt;
+      nextURL = `/posts?max_created_at=${encodeURIComponent(maxCreatedAt)}`;
+    }
+    fetch(nextURL, {
       method: 'GET',
     }).then(response => {
       if (!response.ok) {
@@ -51,6 +58,15 @@ document.addEventListener('DOMContentLoaded', () => {
           lastEl.parentElement.append(el);
         }
       });
+      nextLinks.forEach((el) => el.remove());
+      const newNextLinks = doc.querySelectorAll('.isu-posts-next');
+      newNextLinks.forEach((el) => {
+        lastEl.parentElement.append(el);
+      });
+      // 続きのないページまで読んだ (プロフィールページではmax_created_atに戻れない)
+      if (nextLinks.length > 0 && newNextLinks.length === 0) {
+        postMore.hidden = true;
+      }
       timeago.render(document.querySelectorAll('time.timeago'), 'ja');
       postMore.classList.remove('loading');
     });